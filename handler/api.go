@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Suspender pauses and resumes the containers of a VNFR without removing them
+type Suspender interface {
+	// Pause pauses the VNFC Instance running in the container vcID, or all of them if empty
+	Pause(vnfrID, vcID string) error
+	// Unpause resumes what Pause paused
+	Unpause(vnfrID, vcID string) error
+}
+
+// Api is the operator api of the VNFM, the backups are served only if they are enabled:
+//
+//	POST /vnfrs/<id>/pause[?vnfc=<vc id>]     pause the containers of the VNFR
+//	POST /vnfrs/<id>/resume[?vnfc=<vc id>]    resume the paused containers of the VNFR
+//
+// and the paths of Backups.ServeHTTP. With a Token every request needs the header
+// Authorization: Bearer <token>.
+type Api struct {
+	Logger    *logging.Logger
+	Backups   *Backups
+	Suspender Suspender
+	Token     string
+}
+
+// ApiAddress returns the address the operator api listens on, a port without host like :8090
+// listens on the loopback only, and whether the address is a loopback one
+func ApiAddress(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), true
+	}
+	if host == "localhost" {
+		return addr, true
+	}
+	ip := net.ParseIP(host)
+	return addr, ip != nil && ip.IsLoopback()
+}
+
+// LoadApiToken reads the token of the operator api from a file
+func LoadApiToken(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.New("the token of the operator api is empty")
+	}
+	return token, nil
+}
+
+func (a *Api) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.Token)) == 1
+}
+
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var err error
+	status := http.StatusBadRequest
+	switch {
+	case !a.authorized(r):
+		err = errors.New("missing or invalid token")
+		status = http.StatusUnauthorized
+	case len(parts) == 3 && parts[0] == "vnfrs" && parts[2] == "pause" && r.Method == http.MethodPost && a.Suspender != nil:
+		err = a.Suspender.Pause(parts[1], r.URL.Query().Get("vnfc"))
+	case len(parts) == 3 && parts[0] == "vnfrs" && parts[2] == "resume" && r.Method == http.MethodPost && a.Suspender != nil:
+		err = a.Suspender.Unpause(parts[1], r.URL.Query().Get("vnfc"))
+	case a.Backups != nil:
+		a.Backups.ServeHTTP(w, r)
+		return
+	default:
+		err = fmt.Errorf("%s %s not found", r.Method, r.URL.Path)
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		a.Logger.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
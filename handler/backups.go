@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/mount"
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// Backups archives the volumes of the containers of the VNFRs. Every backup is a directory
+// containing a tarball for each volume and the manifest describing them.
+type Backups struct {
+	Dir        string
+	Logger     *logging.Logger
+	CertFolder string
+	Tsl        bool
+	Timeout    time.Duration
+}
+
+// BackupManifest describes a backup
+type BackupManifest struct {
+	ID       string         `json:"id"`
+	VnfrID   string         `json:"vnfr_id"`
+	VnfrName string         `json:"vnfr_name"`
+	Created  time.Time      `json:"created"`
+	Volumes  []BackupVolume `json:"volumes"`
+}
+
+// BackupVolume is the archive of a volume mounted in a container
+type BackupVolume struct {
+	File        string     `json:"file"`
+	VduID       string     `json:"vdu_id"`
+	ContainerID string     `json:"container_id"`
+	Type        mount.Type `json:"type"`
+	Name        string     `json:"name,omitempty"`
+	Scope       string     `json:"scope,omitempty"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+}
+
+// backupTarget is a running container of a VNFR
+type backupTarget struct {
+	vduID       string
+	vim         *catalogue.DockerVimInstance
+	containerID string
+}
+
+// Create archives the volumes of all the containers of the VNFR, pausing them during the copy
+// if pause is true. In swarm mode only the tasks on the node the VNFM is connected to are
+// reachable.
+func (b *Backups) Create(vnfrID string, pause bool) (*BackupManifest, error) {
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfrID, &cfg, b.Logger); err != nil {
+		return nil, fmt.Errorf("vnfr %s not found: %v", vnfrID, err)
+	}
+	ctx, cancel := newOperation(b.Timeout)
+	defer cancel()
+	manifest := &BackupManifest{
+		ID:       fmt.Sprintf("%s-%s", vnfrID, time.Now().UTC().Format("20060102T150405Z")),
+		VnfrID:   vnfrID,
+		VnfrName: cfg.Name,
+		Created:  time.Now().UTC(),
+		Volumes:  make([]BackupVolume, 0),
+	}
+	targets, err := b.targets(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(b.Dir, manifest.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		cli, err := getClient(target.vim, b.CertFolder, b.Tsl)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		volumes, err := b.archiveContainer(cli, ctx, dir, target, len(manifest.Volumes), pause, cfg.generatedDirs())
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("backup of container %s failed: %v", target.containerID, err)
+		}
+		manifest.Volumes = append(manifest.Volumes, volumes...)
+	}
+	js, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, manifestFile), js, 0600); err != nil {
+		return nil, err
+	}
+	b.Logger.Noticef("%s: Created backup %s of %d volumes", cfg.Name, manifest.ID, len(manifest.Volumes))
+	return manifest, nil
+}
+
+func (b *Backups) targets(ctx context.Context, cfg VnfrConfig) ([]backupTarget, error) {
+	res := make([]backupTarget, 0)
+	for vduID, ids := range cfg.ContainerIDs {
+		for _, id := range ids {
+			res = append(res, backupTarget{vduID: vduID, vim: cfg.vimOfContainer(vduID, id), containerID: id})
+		}
+	}
+	for vduID, service := range cfg.VduService {
+		cli, err := getClient(cfg.VimInstance[vduID], b.CertFolder, b.Tsl)
+		if err != nil {
+			return nil, err
+		}
+		tasks, err := runningTasks(cli, ctx, service.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			containerID := task.Status.ContainerStatus.ContainerID
+			if _, err := cli.ContainerInspect(ctx, containerID); err != nil {
+				b.Logger.Warningf("%s: Task %s on node %s is not reachable and is not archived", cfg.Name, task.ID, task.NodeID)
+				continue
+			}
+			res = append(res, backupTarget{vduID: vduID, vim: cfg.VimInstance[vduID], containerID: containerID})
+		}
+	}
+	return res, nil
+}
+
+// generatedDirs returns the directories holding the files written by the VNFM, the rendered config
+// files and the secrets, their mounts are neither archived nor seeded
+func (c VnfrConfig) generatedDirs() []string {
+	res := []string{secretsDir}
+	for _, file := range c.ConfigFiles {
+		if dir := path.Dir(file.Path); !arrayContains(res, dir) {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+// archiveContainer writes a tarball for every bind mount and volume of the container, except the
+// ones mounted at the skipped directories
+func (b *Backups) archiveContainer(cli *docker.Client, ctx context.Context, dir string, target backupTarget, first int, pause bool, skip []string) ([]BackupVolume, error) {
+	c, err := cli.ContainerInspect(ctx, target.containerID)
+	if err != nil {
+		return nil, err
+	}
+	if pause && c.State != nil && c.State.Running {
+		if err := cli.ContainerPause(ctx, target.containerID); err != nil {
+			return nil, err
+		}
+		defer func() {
+			// the container must not stay paused when the deadline of the backup expired
+			ctx, cancel := newCleanup()
+			defer cancel()
+			if err := cli.ContainerUnpause(ctx, target.containerID); err != nil {
+				b.Logger.Errorf("Unable to unpause container %s: %v", target.containerID, err)
+			}
+		}()
+	}
+	res := make([]BackupVolume, 0, len(c.Mounts))
+	for _, mnt := range c.Mounts {
+		if mnt.Type != mount.TypeVolume && mnt.Type != mount.TypeBind || arrayContains(skip, mnt.Destination) {
+			continue
+		}
+		vol := BackupVolume{
+			File:        fmt.Sprintf("%d.tar", first+len(res)),
+			VduID:       target.vduID,
+			ContainerID: target.containerID,
+			Type:        mnt.Type,
+			Name:        mnt.Name,
+			Source:      mnt.Source,
+			Destination: mnt.Destination,
+		}
+		if mnt.Type == mount.TypeVolume {
+			if v, err := cli.VolumeInspect(ctx, mnt.Name); err == nil {
+				vol.Scope = v.Labels[labelVnfc]
+			}
+		}
+		if err := copyFrom(cli, ctx, target.containerID, mnt.Destination, filepath.Join(dir, vol.File)); err != nil {
+			return nil, err
+		}
+		b.Logger.Debugf("Archived %s of container %s", mnt.Destination, target.containerID)
+		res = append(res, vol)
+	}
+	return res, nil
+}
+
+func copyFrom(cli *docker.Client, ctx context.Context, containerID, srcPath, file string) error {
+	content, _, err := cli.CopyFromContainer(ctx, containerID, srcPath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, content)
+	return err
+}
+
+// Get reads the manifest of a backup
+func (b *Backups) Get(backupID string) (*BackupManifest, error) {
+	if backupID == "" || strings.ContainsAny(backupID, "/\\") || strings.HasPrefix(backupID, ".") {
+		return nil, fmt.Errorf("invalid backup id %s", backupID)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(b.Dir, backupID, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("backup %s not found: %v", backupID, err)
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of backup %s: %v", backupID, err)
+	}
+	return manifest, nil
+}
+
+// List returns the backups of a VNFR, or of all the VNFRs if vnfrID is empty, the newest first
+func (b *Backups) List(vnfrID string) ([]*BackupManifest, error) {
+	entries, err := ioutil.ReadDir(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*BackupManifest, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := b.Get(entry.Name())
+		if err != nil {
+			continue
+		}
+		if vnfrID == "" || manifest.VnfrID == vnfrID {
+			res = append(res, manifest)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.After(res[j].Created)
+	})
+	return res, nil
+}
+
+// SetRestore makes the containers created from now on for the VNFR seed their new volumes from
+// the backup, an empty backupID stops seeding
+func (b *Backups) SetRestore(vnfrID, backupID string) error {
+	defer lockVnfr(vnfrID)()
+	if backupID != "" {
+		if _, err := b.Get(backupID); err != nil {
+			return err
+		}
+	}
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfrID, &cfg, b.Logger); err != nil {
+		return fmt.Errorf("vnfr %s not found: %v", vnfrID, err)
+	}
+	cfg.RestoreBackup = backupID
+	return SaveConfig(vnfrID, cfg, b.Logger)
+}
+
+// newVolumes returns the named volumes of the mounts that do not exist yet, except the ones
+// mounted at the skipped directories
+func newVolumes(cli *docker.Client, ctx context.Context, mounts []mount.Mount, skip []string) []mount.Mount {
+	res := make([]mount.Mount, 0)
+	for _, m := range mounts {
+		if m.Type != mount.TypeVolume || arrayContains(skip, m.Target) {
+			continue
+		}
+		if _, err := cli.VolumeInspect(ctx, m.Source); err != nil {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// volumeFor returns the archive to restore into a volume mounted at the destination, preferring
+// the one of the same VNFC Instance and then the one of the same VDU
+func (m *BackupManifest) volumeFor(vduID, scope, destination string) *BackupVolume {
+	var best *BackupVolume
+	bestScore := -1
+	for i, vol := range m.Volumes {
+		if vol.Destination != destination {
+			continue
+		}
+		score := 0
+		if scope != "" && vol.Scope == scope {
+			score += 2
+		}
+		if vol.VduID == vduID {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = &m.Volumes[i], score
+		}
+	}
+	return best
+}
+
+// seed copies the archives of the backup into the new volumes of a created container
+func (b *Backups) seed(cli *docker.Client, ctx context.Context, manifest *BackupManifest, vduID, scope, containerID string, volumes []mount.Mount) error {
+	for _, m := range volumes {
+		vol := manifest.volumeFor(vduID, scope, m.Target)
+		if vol == nil {
+			b.Logger.Warningf("Backup %s has no archive of %s", manifest.ID, m.Target)
+			continue
+		}
+		f, err := os.Open(filepath.Join(b.Dir, manifest.ID, vol.File))
+		if err != nil {
+			return err
+		}
+		// the archive contains the directory itself
+		err = cli.CopyToContainer(ctx, containerID, path.Dir(m.Target), f, types.CopyToContainerOptions{})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to restore %s from backup %s: %v", m.Target, manifest.ID, err)
+		}
+		b.Logger.Infof("Seeded volume %s from backup %s", m.Source, manifest.ID)
+	}
+	return nil
+}
+
+// ServeHTTP is the operator api of the backups:
+//
+//	GET  /backups[?vnfr=<id>]                 list the backups
+//	GET  /backups/<backup id>                 get the manifest of a backup
+//	POST /vnfrs/<id>/backups[?pause=true]     create a backup of the VNFR
+//	PUT  /vnfrs/<id>/restore                  seed new volumes from the backup in the body {"backup": "<backup id>"}
+func (b *Backups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var res interface{}
+	var err error
+	status := http.StatusBadRequest
+	switch {
+	case len(parts) == 1 && parts[0] == "backups" && r.Method == http.MethodGet:
+		res, err = b.List(r.URL.Query().Get("vnfr"))
+	case len(parts) == 2 && parts[0] == "backups" && r.Method == http.MethodGet:
+		res, err = b.Get(parts[1])
+	case len(parts) == 3 && parts[0] == "vnfrs" && parts[2] == "backups" && r.Method == http.MethodPost:
+		res, err = b.Create(parts[1], r.URL.Query().Get("pause") == "true")
+	case len(parts) == 3 && parts[0] == "vnfrs" && parts[2] == "restore" && r.Method == http.MethodPut:
+		body := struct {
+			Backup string `json:"backup"`
+		}{}
+		if err = json.NewDecoder(r.Body).Decode(&body); err == nil {
+			err = b.SetRestore(parts[1], body.Backup)
+		}
+		res = body
+	default:
+		err = fmt.Errorf("%s %s not found", r.Method, r.URL.Path)
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		b.Logger.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -7,8 +7,29 @@ import (
 	"github.com/dgraph-io/badger"
 	"github.com/op/go-logging"
 	"io/ioutil"
+	"sync"
 )
 
+// vnfrLocks serializes the operations loading, modifying and saving the config of a VNFR
+var vnfrLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockVnfr locks the config of the VNFR and returns the function unlocking it, the operations of
+// the NFVO and of the operator api on the same VNFR run one at a time
+func lockVnfr(vnfrID string) func() {
+	vnfrLocks.Lock()
+	lock, ok := vnfrLocks.locks[vnfrID]
+	if !ok {
+		lock = &sync.Mutex{}
+		vnfrLocks.locks[vnfrID] = lock
+	}
+	vnfrLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
 func deleteConfig(vnfrId string) error {
 	return kv.Delete([]byte(vnfrId))
 }
@@ -20,6 +41,9 @@ func getConfig(vnfrId string, config *VnfrConfig, l *logging.Logger) error {
 	return kvItem.Value(func(bs []byte) error {
 		buf := bytes.NewBuffer(bs)
 		err := gob.NewDecoder(buf).Decode(config)
+		if err == nil {
+			config.ensureMaps()
+		}
 		return err
 	})
 }
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Reactions of the on_dependency_change configuration parameter to a dependency changing the
+// environment of running containers
+const (
+	ReactionIgnore   = "ignore"
+	ReactionRecreate = "recreate"
+	ReactionUpdate   = "update"
+	ReactionExec     = "exec:"
+)
+
+// hookTimeout is the time a reload hook is given to exit
+const hookTimeout = 30 * time.Second
+
+func validDependencyReaction(reaction string) bool {
+	switch reaction {
+	case ReactionIgnore, ReactionRecreate, ReactionUpdate:
+		return true
+	}
+	return strings.HasPrefix(reaction, ReactionExec) && strings.TrimSpace(strings.TrimPrefix(reaction, ReactionExec)) != ""
+}
+
+// replacesContainers returns true if the reaction replaces the containers or the tasks
+func replacesContainers(reaction string) bool {
+	return reaction == ReactionRecreate || reaction == ReactionUpdate
+}
+
+// reloadHook returns the command of an exec reaction, nil for the other reactions
+func reloadHook(reaction string) []string {
+	if !strings.HasPrefix(reaction, ReactionExec) {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(strings.TrimPrefix(reaction, ReactionExec)), " ")
+}
+
+// runReloadHook executes the hook in a container with the new environment
+func runReloadHook(cli *docker.Client, ctx context.Context, containerID string, hook, env []string) error {
+	exitCode, err := execInContainer(cli, ctx, containerID, hook, env, hookTimeout)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("reload hook %v exited with %d in container %s", hook, exitCode, containerID)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"docker.io/go-docker"
 	"docker.io/go-docker/api"
 	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/filters"
 	"docker.io/go-docker/api/types/mount"
 	"docker.io/go-docker/api/types/swarm"
 	"fmt"
@@ -16,7 +17,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"runtime/debug"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 )
@@ -51,14 +52,14 @@ func getClient(instance *catalogue.DockerVimInstance, certDirectory string, tsl
 	return cli, err
 }
 
-func createService(l *logging.Logger, client *docker.Client, ctx context.Context, replicas uint64, image, baseHostname string, cmd, networkIds, pubPorts, constraints []string, aliases map[string][]string) (*swarm.Service, error) {
-	return createServiceWait(l, client, ctx, replicas, image, baseHostname, cmd, networkIds, pubPorts, constraints, aliases, true)
+func createService(l *logging.Logger, client *docker.Client, ctx context.Context, mode swarm.ServiceMode, image, baseHostname string, cmd, networkIds []string, ports []swarm.PortConfig, placement *swarm.Placement, security SecurityProfile, stop StopPolicy, restart *swarm.RestartPolicy, update UpdatePolicy, secrets []*swarm.SecretReference, configs []*swarm.ConfigReference, registryAuth string, aliases map[string][]string) (*swarm.Service, error) {
+	return createServiceWait(l, client, ctx, mode, image, baseHostname, cmd, networkIds, ports, placement, security, stop, restart, update, secrets, configs, registryAuth, aliases, true)
 }
 
-func createServiceWait(l *logging.Logger, client *docker.Client, ctx context.Context, replicas uint64, image, baseHostname string, cmd, networkIds, pubPorts, constraints []string, aliases map[string][]string, waitForIp bool) (*swarm.Service, error) {
+func createServiceWait(l *logging.Logger, client *docker.Client, ctx context.Context, mode swarm.ServiceMode, image, baseHostname string, cmd, networkIds []string, ports []swarm.PortConfig, placement *swarm.Placement, security SecurityProfile, stop StopPolicy, restart *swarm.RestartPolicy, update UpdatePolicy, secrets []*swarm.SecretReference, configs []*swarm.ConfigReference, registryAuth string, aliases map[string][]string, waitForIp bool) (*swarm.Service, error) {
 	networks := make([]swarm.NetworkAttachmentConfig, 0)
 	for _, netId := range networkIds {
-		netName, err := getNetNameFromId(client, netId)
+		netName, err := getNetNameFromId(client, ctx, netId)
 		if err != nil {
 			l.Debugf("Error: %v", err)
 			return nil, err
@@ -77,48 +78,44 @@ func createServiceWait(l *logging.Logger, client *docker.Client, ctx context.Con
 		})
 	}
 
-	var ports []swarm.PortConfig
-	if len(pubPorts) > 1 {
-		trg, err := strconv.ParseUint(pubPorts[1], 10, 32)
-		if err != nil {
-			return nil, err
-		}
-		pub, err := strconv.ParseUint(pubPorts[0], 10, 32)
-		if err != nil {
-			return nil, err
-		}
-		ports = []swarm.PortConfig{{
-			TargetPort:    uint32(trg),
-			PublishedPort: uint32(pub),
-		}}
+	for _, p := range ports {
+		l.Debugf("%s: Publishing %d --> %d/%s (%s)", baseHostname, p.PublishedPort, p.TargetPort, p.Protocol, p.PublishMode)
 	}
 	serviceSpec := swarm.ServiceSpec{
 
-		Mode: swarm.ServiceMode{
-			Replicated: &swarm.ReplicatedService{
-				Replicas: &replicas,
-			},
-		},
+		Mode: mode,
 		EndpointSpec: &swarm.EndpointSpec{
 			Ports: ports,
 		},
 		TaskTemplate: swarm.TaskSpec{
 			ContainerSpec: &swarm.ContainerSpec{
-				Command:  cmd,
-				Image:    image,
-				Hostname: baseHostname,
-			},
-			Networks: networks,
-			Placement: &swarm.Placement{
-				Constraints: constraints,
+				Command:    cmd,
+				Image:      image,
+				Hostname:   baseHostname,
+				Secrets:    secrets,
+				Configs:    configs,
+				StopSignal: stop.Signal,
 			},
+			Networks:      networks,
+			Placement:     placement,
+			RestartPolicy: restart,
 		},
 		Annotations: swarm.Annotations{
 			Name: baseHostname,
 		},
 	}
 
-	serviceCreateOptions := types.ServiceCreateOptions{}
+	serviceSpec.UpdateConfig, serviceSpec.RollbackConfig = update.swarmConfig()
+	if stop.GracePeriod > 0 {
+		serviceSpec.TaskTemplate.ContainerSpec.StopGracePeriod = &stop.GracePeriod
+	}
+	if unsupported := security.applyToService(serviceSpec.TaskTemplate.ContainerSpec); len(unsupported) > 0 {
+		l.Warningf("%s: The security options %v are not supported by swarm services and are ignored", baseHostname, unsupported)
+	}
+
+	serviceCreateOptions := types.ServiceCreateOptions{
+		EncodedRegistryAuth: registryAuth,
+	}
 	resp, err := client.ServiceCreate(ctx, serviceSpec, serviceCreateOptions)
 	if err != nil {
 		debug.PrintStack()
@@ -141,19 +138,24 @@ func createServiceWait(l *logging.Logger, client *docker.Client, ctx context.Con
 	}
 	return srv, nil
 }
+
+// ipTimeout is the time swarm gets to allocate the virtual ips of a created service
+const ipTimeout = time.Minute
+
+// waitUntilIp waits until swarm allocated the virtual ips of the service
 func waitUntilIp(client *docker.Client, ctx context.Context, id string) (*swarm.Service, error) {
-	timeout := 0
-	for {
-		srv, _, err := client.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
-		if hasIp(srv) {
-			return &srv, err
-		}
-		if timeout > 10000 {
-			return nil, errors.New("Timeout waiting for ip")
-		}
-		timeout++
-		time.Sleep(5 * time.Millisecond)
+	ctx, cancel := withTimeout(ctx, ipTimeout)
+	defer cancel()
+	var srv swarm.Service
+	err := poll(ctx, fmt.Sprintf("the virtual ips of service %s", id), func() (bool, error) {
+		var err error
+		srv, _, err = client.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
+		return err == nil && hasIp(srv), err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &srv, nil
 }
 func hasIp(service swarm.Service) bool {
 	for _, virtualIP := range service.Endpoint.VirtualIPs {
@@ -165,90 +167,155 @@ func hasIp(service swarm.Service) bool {
 	return false
 }
 
-func updateService(l *logging.Logger, client *docker.Client, ctx context.Context, service *swarm.Service, replica uint64, env, mnts, constraints []string, restartPolicy string) error {
-	mounts := make([]mount.Mount, len(mnts))
-	var rp swarm.RestartPolicyCondition
-	if restartPolicy == "on-failure" {
-		rp = swarm.RestartPolicyConditionOnFailure
-	} else if restartPolicy == "any" {
-		rp = swarm.RestartPolicyConditionAny
-	} else {
-		rp = swarm.RestartPolicyConditionNone
+// updateService sets the mode, the environment, the mounts, the placement and the restart policy
+// of the service, the rest of its spec is kept
+func updateService(l *logging.Logger, client *docker.Client, ctx context.Context, service *swarm.Service, mode swarm.ServiceMode, env []string, mounts []mount.Mount, placement *swarm.Placement, restart *swarm.RestartPolicy, registryAuth string) error {
+	return patchService(client, ctx, service, registryAuth, func(spec *swarm.ServiceSpec) {
+		spec.Mode = mode
+		spec.TaskTemplate.ContainerSpec.Env = env
+		spec.TaskTemplate.ContainerSpec.Mounts = mounts
+		spec.TaskTemplate.Placement = placement
+		spec.TaskTemplate.RestartPolicy = restart
+	})
+}
+
+// runningTasks returns the running tasks of a service that have a container
+func runningTasks(cli *docker.Client, ctx context.Context, serviceID string) ([]swarm.Task, error) {
+	args := filters.NewArgs()
+	args.Add("service", serviceID)
+	args.Add("desired-state", "running")
+	tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: args})
+	if err != nil {
+		return nil, err
 	}
-	for i, mnt := range mnts {
-		split := strings.Split(mnt, ":")
-		readOnly := false
-		if len(split) > 2 {
-			readOnly = split[2] == "ro"
-		}
-		l.Debugf("%s: Mount  %s --> %s", service.Spec.Name, split[0], split[1])
-		mounts[i] = mount.Mount{
-			Source:   split[0],
-			Target:   split[1],
-			ReadOnly: readOnly,
+	res := make([]swarm.Task, 0, len(tasks))
+	for _, task := range tasks {
+		if task.Status.ContainerStatus.ContainerID != "" {
+			res = append(res, task)
 		}
 	}
-	var maxAttempt uint64 = 0
-	serviceSpec := swarm.ServiceSpec{
-		Mode: swarm.ServiceMode{
-			Replicated: &swarm.ReplicatedService{
-				Replicas: &replica,
-			},
-		},
-		TaskTemplate: swarm.TaskSpec{
-			Placement: &swarm.Placement{
-				Constraints: constraints,
-			},
-			RestartPolicy: &swarm.RestartPolicy{
-				MaxAttempts: &maxAttempt,
-				Condition:   rp,
-			},
-			ContainerSpec: &swarm.ContainerSpec{
-				Image:    service.Spec.TaskTemplate.ContainerSpec.Image,
-				Hostname: service.Spec.TaskTemplate.ContainerSpec.Hostname,
-				Command:  service.Spec.TaskTemplate.ContainerSpec.Command,
-				Env:      env,
-				Mounts:   mounts,
-			},
-			Networks: service.Spec.TaskTemplate.Networks,
-		},
-		EndpointSpec: service.Spec.EndpointSpec,
-		Annotations:  service.Spec.Annotations,
-	}
-	serviceCreateOptions := types.ServiceUpdateOptions{}
+	return res, nil
+}
 
-	srv, _, _ := client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+// envChanged compares two environments ignoring the order of the variables
+func envChanged(oldEnv, newEnv []string) bool {
+	if len(oldEnv) != len(newEnv) {
+		return true
+	}
+	a := append([]string(nil), oldEnv...)
+	b := append([]string(nil), newEnv...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return true
+		}
+	}
+	return false
+}
 
-	_, err := client.ServiceUpdate(ctx, service.ID, srv.Version, serviceSpec, serviceCreateOptions)
+// execInContainer runs a command in a running container and waits for its exit code
+func execInContainer(cli *docker.Client, ctx context.Context, containerID string, cmd, env []string, timeout time.Duration) (int, error) {
+	exec, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd: cmd,
+		Env: env,
+	})
 	if err != nil {
-
-		return err
+		return 0, err
 	}
-	*service, _, err = client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
-	return err
+	if err := cli.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{}); err != nil {
+		return 0, err
+	}
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	var exitCode int
+	err = poll(ctx, fmt.Sprintf("%v in container %s", cmd, containerID), func() (bool, error) {
+		inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+		exitCode = inspect.ExitCode
+		return err == nil && !inspect.Running, err
+	})
+	return exitCode, err
 }
 
+// Formats of the variables of the dependencies, selected by the env_format configuration
+// parameter
+const (
+	EnvFlat    = "flat"
+	EnvIndexed = "indexed"
+)
+
+// GetEnv returns the environment of the containers sorted by name. The parameters of the
+// dependencies are NAME_KEY for every instance in the flat format, in the indexed format they
+// are NAME_KEY_0, NAME_KEY_1, NAME_KEY_ALL with the comma joined values and NAME_COUNT.
 func GetEnv(l *logging.Logger, cfg VnfrConfig) []string {
-	envList := make([]string, len(cfg.Own))
-	x := 0
-	for k, v := range cfg.Own {
-		envList[x] = fmt.Sprintf("%s=%s", k, v)
-		x++
+	envList := make([]string, 0, len(cfg.Own))
+	for _, k := range sortedKeys(cfg.Own) {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, cfg.Own[k]))
 	}
-	x = 0
-	for k, dp := range cfg.Foreign {
-		for _, kv := range dp {
-			for key, val := range kv {
-				envList = append(envList, fmt.Sprintf("%s_%s=%s", strings.ToUpper(k), strings.ToUpper(key), val))
-				x++
+	foreignNames := make([]string, 0, len(cfg.Foreign))
+	for k := range cfg.Foreign {
+		foreignNames = append(foreignNames, k)
+	}
+	sort.Strings(foreignNames)
+	for _, k := range foreignNames {
+		prefix := strings.ToUpper(k)
+		if cfg.EnvFormat == EnvIndexed {
+			envList = append(envList, indexedEnv(prefix, cfg.Foreign[k])...)
+			continue
+		}
+		for _, kv := range cfg.Foreign[k] {
+			for _, key := range sortedKeys(kv) {
+				envList = append(envList, fmt.Sprintf("%s_%s=%s", prefix, strings.ToUpper(key), kv[key]))
 			}
 		}
 	}
+	envList = append(envList, secretEnv(cfg.Secrets)...)
 	l.Noticef("%s: EnvVar: %v", cfg.Name, envList)
 	return envList
 }
 
-func getNetNameFromId(cl *docker.Client, netId string) (string, error) {
+func indexedEnv(prefix string, instances []map[string]string) []string {
+	keys := make([]string, 0)
+	for _, kv := range instances {
+		for key := range kv {
+			if !arrayContains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	env := []string{fmt.Sprintf("%s_COUNT=%d", prefix, len(instances))}
+	for _, key := range keys {
+		name := fmt.Sprintf("%s_%s", prefix, strings.ToUpper(key))
+		all := make([]string, 0, len(instances))
+		for i, kv := range instances {
+			if val, ok := kv[key]; ok {
+				env = append(env, fmt.Sprintf("%s_%d=%s", name, i, val))
+				all = append(all, val)
+			}
+		}
+		env = append(env, fmt.Sprintf("%s_ALL=%s", name, strings.Join(all, ",")))
+	}
+	return env
+}
+
+// foreignParameters returns the parameters of the VNFC Instances of a dependency sorted by their
+// key, so that the same dependency always gives the same environment
+func foreignParameters(l *logging.Logger, vnfcDepParam *catalogue.VNFCDependencyParameters) []map[string]string {
+	keys := make([]string, 0, len(vnfcDepParam.Parameters))
+	for key := range vnfcDepParam.Parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		l.Debugf("Adding to config.foreign: %s", vnfcDepParam.Parameters[key].Parameters)
+		res[i] = vnfcDepParam.Parameters[key].Parameters
+	}
+	return res
+}
+
+func getNetNameFromId(cl *docker.Client, ctx context.Context, netId string) (string, error) {
 	nets, _ := cl.NetworkList(ctx, types.NetworkListOptions{})
 	for _, networkResource := range nets {
 		if networkResource.ID == netId {
@@ -258,14 +325,19 @@ func getNetNameFromId(cl *docker.Client, netId string) (string, error) {
 	return "", errors.New(fmt.Sprintf("No network with id %v", netId))
 }
 
-func GetIpsFromService(cli *docker.Client, l *logging.Logger, config *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, srv *swarm.Service) (ips []*catalogue.IP, fips []*catalogue.IP, err error) {
+func GetIpsFromService(cli *docker.Client, ctx context.Context, l *logging.Logger, config *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, srv *swarm.Service) (ips []*catalogue.IP, fips []*catalogue.IP, err error) {
 	err = nil
-	fips = make([]*catalogue.IP, 0)
 	ips = make([]*catalogue.IP, 0)
 	l.Debugf("%v", *srv)
+	ports := srv.Endpoint.Ports
+	if len(ports) == 0 && srv.Spec.EndpointSpec != nil {
+		// ports published in host mode are not part of the endpoint
+		ports = srv.Spec.EndpointSpec.Ports
+	}
+	fips = publishedServicePortIPs(ports)
 	for _, virtualIP := range (*srv).Endpoint.VirtualIPs {
 		l.Debugf("%v, IP: %v", vnfr.Name, virtualIP)
-		nameFromId, err := getNetNameFromId(cli, virtualIP.NetworkID)
+		nameFromId, err := getNetNameFromId(cli, ctx, virtualIP.NetworkID)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -275,10 +347,6 @@ func GetIpsFromService(cli *docker.Client, l *logging.Logger, config *VnfrConfig
 			IP:      ownIp,
 			NetName: nameFromId,
 		})
-		//fips = append(fips, &catalogue.IP{
-		//	NetName: nameFromId,
-		//	IP:      strings.Split(strings.Split(vimInstanceChosen.AuthURL, "//")[1], ":")[0],
-		//})
 	}
 	return
 }
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/versions"
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FeasibilityProblem is a reason why a VNFR cannot be deployed on a vim instance
+type FeasibilityProblem struct {
+	VimInstance string
+	Check       string
+	Message     string
+}
+
+// FeasibilityReport collects all the problems found while checking the feasibility of an
+// instantiation, it is returned as error when a VDU can not be hosted by any of its vim instances
+type FeasibilityReport struct {
+	Vnfr       string
+	Problems   []FeasibilityProblem
+	Infeasible []string
+}
+
+func (r *FeasibilityReport) add(vimName, check, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, FeasibilityProblem{
+		VimInstance: vimName,
+		Check:       check,
+		Message:     fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *FeasibilityReport) Error() string {
+	return fmt.Sprintf("Instantiation of %s is not feasible: %s", r.Vnfr, r.problems())
+}
+
+func (r *FeasibilityReport) problems() string {
+	msgs := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		msgs[i] = fmt.Sprintf("[%s] %s: %s", p.VimInstance, p.Check, p.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (r *FeasibilityReport) err() error {
+	if len(r.Infeasible) == 0 {
+		return nil
+	}
+	return r
+}
+
+type feasibilityCheck struct {
+	l          *logging.Logger
+	ctx        context.Context
+	certFolder string
+	tsl        bool
+	swarmMode  bool
+	creds      *RegistryCredentials
+	report     *FeasibilityReport
+	clients    map[string]*docker.Client
+}
+
+// checkFeasibility verifies, for every candidate vim instance of every VDU, that the docker
+// daemon is reachable with a compatible api version, that the image and the networks are
+// available, that fixed ips and host ports are free and that the requested resources fit. The
+// vim instances passing the checks are returned by VDU id, the instantiation is not feasible only
+// if a VDU has none where its VNFC Instances fit.
+func checkFeasibility(l *logging.Logger, ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg VnfrConfig, vimInstances map[string][]interface{}, certFolder string, tsl, swarmMode bool, creds *RegistryCredentials) (map[string][]*catalogue.DockerVimInstance, error) {
+	fc := &feasibilityCheck{
+		l:          l,
+		ctx:        ctx,
+		certFolder: certFolder,
+		tsl:        tsl,
+		swarmMode:  swarmMode,
+		creds:      creds,
+		report:     &FeasibilityReport{Vnfr: vnfr.Name},
+		clients:    make(map[string]*docker.Client),
+	}
+	suitable := make(map[string][]*catalogue.DockerVimInstance, len(vnfr.VDUs))
+	for _, vdu := range vnfr.VDUs {
+		candidates := dockerVimInstances(vimInstances[vdu.ParentVDU])
+		if len(candidates) == 0 {
+			continue
+		}
+		for _, vim := range candidates {
+			cl := fc.client(vim)
+			if cl == nil {
+				continue
+			}
+			problems := len(fc.report.Problems)
+			fc.checkImage(cl, vim, cfg, vdu)
+			fc.checkNetworks(cl, vim, vdu)
+			fc.checkPorts(cl, vim, cfg.Vdu(vdu.ID).Ports)
+			if len(fc.report.Problems) == problems {
+				suitable[vdu.ID] = append(suitable[vdu.ID], vim)
+			}
+		}
+		if len(suitable[vdu.ID]) == 0 {
+			fc.report.add(vimNames(candidates), "vdu", "no vim instance can host VDU %s", vdu.ID)
+			fc.report.Infeasible = append(fc.report.Infeasible, vdu.ID)
+		} else if !fc.checkResources(cfg, vdu, suitable[vdu.ID]) {
+			fc.report.Infeasible = append(fc.report.Infeasible, vdu.ID)
+		}
+	}
+	if err := fc.report.err(); err != nil {
+		l.Errorf("%v", err)
+		return nil, err
+	}
+	if len(fc.report.Problems) > 0 {
+		l.Warningf("%s: Vim Instances excluded from the placement: %s", vnfr.Name, fc.report.problems())
+	}
+	return suitable, nil
+}
+
+// client returns the client of a reachable vim instance with a compatible api version
+func (fc *feasibilityCheck) client(vim *catalogue.DockerVimInstance) *docker.Client {
+	if cl, ok := fc.clients[vim.ID]; ok {
+		return cl
+	}
+	fc.clients[vim.ID] = nil
+	cl, err := getClient(vim, fc.certFolder, fc.tsl)
+	if err != nil {
+		fc.report.add(vim.Name, "reachability", "%v", err)
+		return nil
+	}
+	version, err := cl.ServerVersion(fc.ctx)
+	if err != nil {
+		fc.report.add(vim.Name, "reachability", "%v", err)
+		return nil
+	}
+	if versions.LessThan(version.APIVersion, api.DefaultVersion) {
+		fc.report.add(vim.Name, "api-version", "daemon api version %s is older than %s", version.APIVersion, api.DefaultVersion)
+		return nil
+	}
+	if fc.swarmMode {
+		info, err := cl.Info(fc.ctx)
+		if err != nil {
+			fc.report.add(vim.Name, "reachability", "%v", err)
+			return nil
+		}
+		if !info.Swarm.ControlAvailable {
+			fc.report.add(vim.Name, "swarm", "the docker daemon is not a swarm manager")
+			return nil
+		}
+	}
+	fc.clients[vim.ID] = cl
+	return cl
+}
+
+func (fc *feasibilityCheck) checkImage(cl *docker.Client, vim *catalogue.DockerVimInstance, cfg VnfrConfig, vdu *catalogue.VirtualDeploymentUnit) {
+	images := vdu.VMImages
+	if vduCfg := cfg.Vdu(vdu.ID); vduCfg.ImageName != "" {
+		images = []string{vduCfg.ImageName}
+	}
+	for _, image := range images {
+		if imagePresent(cl, fc.ctx, vim, image) {
+			return
+		}
+		if cfg.PullPolicy == PullNever {
+			continue
+		}
+		auth, err := fc.creds.auth(vim, image)
+		if err != nil {
+			fc.report.add(vim.Name, "image", "%v", err)
+			return
+		}
+		if _, err := cl.DistributionInspect(fc.ctx, image, auth); err == nil {
+			return
+		}
+	}
+	if cfg.PullPolicy == PullNever {
+		fc.report.add(vim.Name, "image", "none of the images %v is present and pull policy is %s", images, PullNever)
+		return
+	}
+	fc.report.add(vim.Name, "image", "none of the images %v is available or pullable", images)
+}
+
+func (fc *feasibilityCheck) checkNetworks(cl *docker.Client, vim *catalogue.DockerVimInstance, vdu *catalogue.VirtualDeploymentUnit) {
+	for _, vnfc := range vdu.VNFCs {
+		for _, cp := range vnfc.ConnectionPoints {
+			netDoc, err := cl.NetworkInspect(fc.ctx, cp.VirtualLinkReference, types.NetworkInspectOptions{})
+			if err != nil && cp.VirtualLinkReferenceId != "" {
+				netDoc, err = cl.NetworkInspect(fc.ctx, cp.VirtualLinkReferenceId, types.NetworkInspectOptions{})
+			}
+			if err != nil {
+				// the network is created by the vim driver, a fixed ip can not be checked
+				fc.l.Debugf("Network %s does not exist yet on %s", cp.VirtualLinkReference, vim.Name)
+				continue
+			}
+			if fc.swarmMode && netDoc.Scope != "swarm" {
+				fc.report.add(vim.Name, "network", "network %s has scope %s, swarm services need a swarm scoped network", netDoc.Name, netDoc.Scope)
+			}
+			if cp.FixedIp != "" {
+				if msg := fixedIPProblem(netDoc, cp.FixedIp); msg != "" {
+					fc.report.add(vim.Name, "fixed-ip", "%s", msg)
+				}
+			}
+		}
+	}
+}
+
+// fixedIPProblem checks that the ip is in the ipam range of the network and not used
+func fixedIPProblem(netDoc types.NetworkResource, fixedIP string) string {
+	ip := net.ParseIP(fixedIP)
+	if ip == nil {
+		return fmt.Sprintf("%s is not a valid ip", fixedIP)
+	}
+	inRange := false
+	for _, ipam := range netDoc.IPAM.Config {
+		if ipam.Gateway == fixedIP {
+			return fmt.Sprintf("%s is the gateway of network %s", fixedIP, netDoc.Name)
+		}
+		subnet := ipam.Subnet
+		if ipam.IPRange != "" {
+			subnet = ipam.IPRange
+		}
+		if _, ipNet, err := net.ParseCIDR(subnet); err == nil && ipNet.Contains(ip) {
+			inRange = true
+		}
+	}
+	if !inRange {
+		return fmt.Sprintf("%s is not in the ip range of network %s", fixedIP, netDoc.Name)
+	}
+	for _, endpoint := range netDoc.Containers {
+		if strings.Split(endpoint.IPv4Address, "/")[0] == fixedIP {
+			return fmt.Sprintf("%s is already used by %s in network %s", fixedIP, endpoint.Name, netDoc.Name)
+		}
+	}
+	return ""
+}
+
+func (fc *feasibilityCheck) checkPorts(cl *docker.Client, vim *catalogue.DockerVimInstance, ports []PortMapping) {
+	if len(ports) == 0 {
+		return
+	}
+	bound := make(map[string]bool)
+	if fc.swarmMode {
+		services, err := cl.ServiceList(fc.ctx, types.ServiceListOptions{})
+		if err != nil {
+			fc.report.add(vim.Name, "port", "%v", err)
+			return
+		}
+		for _, srv := range services {
+			for _, p := range srv.Endpoint.Ports {
+				bound[fmt.Sprintf("%d/%s", p.PublishedPort, p.Protocol)] = true
+			}
+		}
+	} else {
+		containers, err := cl.ContainerList(fc.ctx, types.ContainerListOptions{})
+		if err != nil {
+			fc.report.add(vim.Name, "port", "%v", err)
+			return
+		}
+		for _, cont := range containers {
+			for _, p := range cont.Ports {
+				if p.PublicPort != 0 {
+					bound[fmt.Sprintf("%d/%s", p.PublicPort, p.Type)] = true
+				}
+			}
+		}
+	}
+	for _, p := range ports {
+		if _, err := strconv.ParseUint(p.HostPort, 10, 16); err != nil {
+			// random port or dynamic range
+			continue
+		}
+		if bound[fmt.Sprintf("%s/%s", p.HostPort, p.Protocol)] {
+			fc.report.add(vim.Name, "port", "host port %s/%s is already bound", p.HostPort, p.Protocol)
+		}
+	}
+}
+
+// vimNames returns the comma joined names of the vim instances
+func vimNames(vims []*catalogue.DockerVimInstance) string {
+	names := make([]string, len(vims))
+	for i, vim := range vims {
+		names[i] = vim.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// checkResources places all the VNFCs of the VDU without deploying them, it returns false if they
+// do not fit
+func (fc *feasibilityCheck) checkResources(cfg VnfrConfig, vdu *catalogue.VirtualDeploymentUnit, vims []*catalogue.DockerVimInstance) bool {
+	p, err := newPlacement(fc.l, fc.ctx, cfg.Placement, vims, fc.certFolder, fc.tsl)
+	if err != nil {
+		fc.report.add(vimNames(vims), "resources", "%v", err)
+		return false
+	}
+	count := len(vdu.VNFCs)
+	if fc.swarmMode {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		if _, err := p.place(placementRequest(cfg, vdu.ID)); err != nil {
+			fc.report.add(vimNames(vims), "resources", "VNFC %d of VDU %s: %v", i, vdu.ID, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/swarm"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ParseExternalAddresses parses a list like vim-name=1.2.3.4,other-vim=host.example.org mapping
+// the name or id of a vim instance to the address under which its published ports are reachable
+func ParseExternalAddresses(value string) map[string]string {
+	res := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		split := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(split) == 2 && split[0] != "" && split[1] != "" {
+			res[split[0]] = split[1]
+		}
+	}
+	return res
+}
+
+// externalAddress returns the configured external address of the vim instance or the host
+// of its endpoint. An empty string is returned for local sockets.
+func externalAddress(vim *catalogue.DockerVimInstance, external map[string]string) string {
+	if addr, ok := external[vim.Name]; ok {
+		return addr
+	}
+	if addr, ok := external[vim.ID]; ok {
+		return addr
+	}
+	return hostFromURL(vim.AuthURL)
+}
+
+func hostFromURL(authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil || u.Scheme == "unix" || u.Scheme == "npipe" {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// floatingIPs returns one entry per network with the host as ip, followed by the published
+// ports with their unspecified bind address replaced by the host
+func floatingIPs(host string, netNames []string, portIPs []*catalogue.IP) []*catalogue.IP {
+	if host == "" {
+		return portIPs
+	}
+	res := make([]*catalogue.IP, 0, len(netNames)+len(portIPs))
+	for _, netName := range netNames {
+		res = append(res, &catalogue.IP{
+			NetName: netName,
+			IP:      host,
+		})
+	}
+	for _, portIP := range portIPs {
+		bindIP, port, err := net.SplitHostPort(portIP.IP)
+		if err == nil && (bindIP == "" || bindIP == "0.0.0.0" || bindIP == "::") {
+			portIP = &catalogue.IP{
+				NetName: portIP.NetName,
+				IP:      net.JoinHostPort(host, port),
+			}
+		}
+		res = append(res, portIP)
+	}
+	return res
+}
+
+func netNamesOf(ips []*catalogue.IP) []string {
+	res := make([]string, len(ips))
+	for i, ip := range ips {
+		res[i] = ip.NetName
+	}
+	return res
+}
+
+func sortedKeys(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// serviceAddresses returns the addresses under which the published ports of a swarm service are
+// reachable: the configured external address of the vim instance, the node addresses, or
+// as last resort the host of the vim endpoint
+func serviceAddresses(cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, external map[string]string) []string {
+	if addr, ok := external[vim.Name]; ok {
+		return []string{addr}
+	}
+	if addr, ok := external[vim.ID]; ok {
+		return []string{addr}
+	}
+	addrs, err := swarmNodeAddresses(cli, ctx)
+	if err != nil || len(addrs) == 0 {
+		return []string{hostFromURL(vim.AuthURL)}
+	}
+	return addrs
+}
+
+// swarmNodeAddresses returns the sorted addresses of the ready and active nodes of the swarm
+func swarmNodeAddresses(cli *docker.Client, ctx context.Context) ([]string, error) {
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, node := range nodes {
+		if node.Status.State != swarm.NodeStateReady || node.Spec.Availability != "active" {
+			continue
+		}
+		addr := node.Status.Addr
+		if (addr == "" || addr == "0.0.0.0") && node.ManagerStatus != nil {
+			addr, _, _ = net.SplitHostPort(node.ManagerStatus.Addr)
+		}
+		if addr != "" && addr != "0.0.0.0" {
+			res = append(res, addr)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -12,7 +12,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger"
-	"github.com/docker/go-connections/nat"
 	"github.com/op/go-logging"
 	"github.com/openbaton/go-openbaton/catalogue"
 	"math"
@@ -25,21 +24,43 @@ import (
 var (
 	opt = badger.DefaultOptions
 	kv  *badger.KV
-	ctx = context.Background()
 )
 
 type VnfmImpl struct {
-	Logger     *logging.Logger
-	Tsl        bool
-	CertFolder string
+	Logger            *logging.Logger
+	Tsl               bool
+	CertFolder        string
+	ExternalAddresses map[string]string
+	Credentials       *RegistryCredentials
+	Policy            *ImagePolicy
+	Security          SecurityProfile
+	Secrets           SecretSource
+	Backups           *Backups
+	Timeout           time.Duration
 }
 
+// ActionForResume returns ActionResume for the VNFC Instances paused by the VNFM and ActionStart
+// if the containers of the VNFR were never started
 func (h *VnfmImpl) ActionForResume(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance) catalogue.Action {
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		return catalogue.NoActionSpecified
+	}
+	started := len(cfg.ContainerVim) > 0
+	switch {
+	case vnfcInstance == nil && len(cfg.Paused) > 0:
+		return catalogue.ActionResume
+	case vnfcInstance != nil && cfg.Paused[vnfcInstance.VCID]:
+		return catalogue.ActionResume
+	case !started:
+		return catalogue.ActionStart
+	}
 	return catalogue.NoActionSpecified
 }
 
+// CheckInstantiationFeasibility does not receive the VNFR nor the vim instances, the feasibility
+// of a deployment is checked at the beginning of Instantiate by checkFeasibility
 func (h *VnfmImpl) CheckInstantiationFeasibility() error {
-
 	return nil
 }
 
@@ -52,50 +73,162 @@ func (h *VnfmImpl) HandleError(vnfr *catalogue.VirtualNetworkFunctionRecord) err
 	return nil
 }
 
+// Heal migrates the VNFC Instance to another vim instance of its VDU if the cause is
+// migrate:<vim instance>[:volumes], the returned VNFR has its new vim instance, container and ips.
+// Otherwise the states of the VNFC Instances are read from their containers.
 func (h *VnfmImpl) Heal(vnfr *catalogue.VirtualNetworkFunctionRecord, component *catalogue.VNFCInstance, cause string) (*catalogue.VirtualNetworkFunctionRecord, error) {
-	return vnfr, nil
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	target, volumes, ok := parseMigration(cause)
+	cfg := VnfrConfig{}
+	err := getConfig(vnfr.ID, &cfg, h.Logger)
+	if err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	if !ok || component == nil {
+		// the containers are restarted by docker according to restart_policy
+		h.reportStates(ctx, vnfr, cfg)
+		return vnfr, nil
+	}
+	for _, vdu := range vnfr.VDUs {
+		for _, vnfc := range vdu.VNFCInstances {
+			if vnfc.ID != component.ID || vnfc.VCID == "" {
+				continue
+			}
+			err := h.migrate(ctx, vnfr, &cfg, vdu.ID, vnfc, target, volumes)
+			SaveConfig(vnfr.ID, cfg, h.Logger)
+			if err != nil {
+				h.Logger.Errorf("%s: %v", cfg.Name, err)
+				return nil, err
+			}
+			return vnfr, nil
+		}
+	}
+	return nil, fmt.Errorf("VNFR %s has no running VNFC Instance %s", vnfr.Name, component.ID)
 }
 
 func (h *VnfmImpl) Instantiate(vnfr *catalogue.VirtualNetworkFunctionRecord, scripts interface{}, vimInstances map[string][]interface{}) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	if vnfr.VDUs == nil {
 		return nil, errors.New("no VDU provided")
 	}
 	config := NewVnfrConfig(vnfr)
-	FillConfig(vnfr, &config, h.Logger)
+	config.Security = h.Security.clone()
+	_, err := FillConfig(vnfr, &config, h.Logger)
+	if err != nil {
+		h.Logger.Errorf("Error while reading configuration: %v", err)
+		return nil, err
+	}
+	err = config.loadTemplates(vnfr, scripts)
+	if err == nil {
+		_, _, err = config.renderConfigFiles()
+	}
+	if err != nil {
+		h.Logger.Errorf("Error while reading the config files: %v", err)
+		return nil, err
+	}
+	suitable, err := checkFeasibility(h.Logger, ctx, vnfr, config, vimInstances, h.CertFolder, h.Tsl, false, h.Credentials)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, vdu := range vnfr.VDUs {
 		vdu.VNFCInstances = make([]*catalogue.VNFCInstance, 0)
-		vimInstanceChosen := vimInstances[vdu.ParentVDU][rand.Intn(len(vimInstances[vdu.ParentVDU]))]
-		dockerVimInstance := vimInstanceChosen.(*catalogue.DockerVimInstance)
-		config.VimInstance[vdu.ID] = dockerVimInstance
-
-		h.Logger.Debugf("%v VNF has %v VNFC(s)", vnfr.Name, len(vdu.VNFCs))
-
-		cl, err := getClient(dockerVimInstance, h.CertFolder, h.Tsl)
+		candidates := dockerVimInstances(vimInstances[vdu.ParentVDU])
+		if len(candidates) == 0 {
+			return nil, errors.New(fmt.Sprintf("no Docker Vim Instance provided for VDU %s", vdu.ID))
+		}
+		for _, vim := range candidates {
+			config.addVim(vdu.ID, vim)
+		}
+		p, err := newPlacement(h.Logger, ctx, config.Placement, suitable[vdu.ID], h.CertFolder, h.Tsl)
 		if err != nil {
-			h.Logger.Errorf("Error while getting client: %v", err)
+			h.Logger.Errorf("Error while placing VDU %s: %v", vdu.ID, err)
 			return nil, err
 		}
-		ips, cps, _, err := GetCPsAndIpsFromFixedIps(cl, vdu.VNFCs[0], h.Logger, vnfr, config)
 
-		if err != nil {
-			h.Logger.Errorf("Error while getting CP: %v", err)
-			return nil, err
+		h.Logger.Debugf("%v VNF has %v VNFC(s)", vnfr.Name, len(vdu.VNFCs))
+
+		vduCfg := config.Vdu(vdu.ID)
+		images := vdu.VMImages
+		if vduCfg.ImageName != "" {
+			images = []string{vduCfg.ImageName}
 		}
-		imageChosen, err := chooseImage(vdu, dockerVimInstance)
-		hostname := fmt.Sprintf("%s", vnfr.Name)
+		images, err = h.Policy.allowed(vnfr.ProjectID, images)
 		if err != nil {
-			debug.PrintStack()
+			h.Logger.Errorf("%v", err)
 			return nil, err
 		}
-		config.ImageName = imageChosen
+		hostname := fmt.Sprintf("%s", vnfr.Name)
+		var imageChosen, imageDigest string
+		withImage := make(map[string]bool)
+		for i, vnfc := range vdu.VNFCs {
+			dockerVimInstance, err := p.place(placementRequest(config, vdu.ID))
+			if err != nil {
+				h.Logger.Errorf("Error while placing VNFC of VDU %s: %v", vdu.ID, err)
+				return nil, err
+			}
+			if i == 0 {
+				config.VimInstance[vdu.ID] = dockerVimInstance
+			}
 
-		SetupVNFCInstance(vdu, dockerVimInstance, hostname, cps, nil, ips)
+			cl, err := getClient(dockerVimInstance, h.CertFolder, h.Tsl)
+			if err != nil {
+				h.Logger.Errorf("Error while getting client: %v", err)
+				return nil, err
+			}
+			netCfg := make(map[string]NetConf)
+			ips, cps, _, err := GetCPsAndIpsFromFixedIps(cl, ctx, vnfc, h.Logger, vnfr, config, netCfg)
+			if err != nil {
+				h.Logger.Errorf("Error while getting CP: %v", err)
+				return nil, err
+			}
+			if i == 0 {
+				imageChosen, err = chooseImage(h.Logger, cl, ctx, dockerVimInstance, images, config.PullPolicy, h.Credentials)
+				if err == nil {
+					imageDigest, err = pinImage(h.Logger, cl, ctx, dockerVimInstance, imageChosen, h.Credentials)
+				}
+				if err == nil {
+					err = h.Policy.verify(vnfr.ProjectID, imageDigest)
+				}
+				config.setVdu(vdu.ID, func(vc *VduConfig) {
+					vc.ImageName = imageChosen
+					vc.ImageDigest = imageDigest
+					vc.NetworkCfg = withoutIPs(netCfg)
+				})
+			} else if !withImage[dockerVimInstance.ID] {
+				err = ensureImage(h.Logger, cl, ctx, dockerVimInstance, imageDigest, config.PullPolicy, h.Credentials)
+			}
+			if err != nil {
+				debug.PrintStack()
+				return nil, err
+			}
+			withImage[dockerVimInstance.ID] = true
+			if vnfc.ID != "" {
+				config.VnfcNetworks[vnfc.ID] = netCfg
+			}
+
+			var fips []*catalogue.IP
+			if len(vduCfg.Ports) > 0 {
+				_, bindings, err := toPortBindings(vduCfg.Ports)
+				if err != nil {
+					return nil, err
+				}
+				fips = floatingIPs(externalAddress(dockerVimInstance, h.ExternalAddresses), netNamesOf(ips), publishedPortIPs(bindings))
+			}
+			vdu.VNFCInstances = append(vdu.VNFCInstances, newVnfcInstance(dockerVimInstance, hostname, vnfc, cps, fips, ips))
+		}
+		config.PlacementPos[vdu.ID] = p.position()
+		h.Logger.Debugf("%s: VDU %s uses image %s pinned to %s", vnfr.Name, vdu.ID, imageChosen, imageDigest)
 
 		config.Name = vnfr.Name
 	}
 
-	err := SaveConfig(vnfr.ID, config, h.Logger)
+	err = SaveConfig(vnfr.ID, config, h.Logger)
 	if err != nil {
 		h.Logger.Errorf("Error: %v", err)
 		return nil, err
@@ -103,7 +236,7 @@ func (h *VnfmImpl) Instantiate(vnfr *catalogue.VirtualNetworkFunctionRecord, scr
 	return vnfr, err
 }
 
-func getNetworkIdsFromNames(cli *docker.Client, netNames []string) ([]string, error) {
+func getNetworkIdsFromNames(cli *docker.Client, ctx context.Context, netNames []string) ([]string, error) {
 	nets, err := cli.NetworkList(ctx, types.NetworkListOptions{})
 	if err != nil {
 		return nil, err
@@ -121,6 +254,9 @@ func getNetworkIdsFromNames(cli *docker.Client, netNames []string) ([]string, er
 }
 
 func (h *VnfmImpl) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	js, _ := json.Marshal(dependency)
 	h.Logger.Debugf("DepencencyRecord is: %s", string(js))
 	config := VnfrConfig{}
@@ -129,18 +265,13 @@ func (h *VnfmImpl) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord, dependen
 		h.Logger.Errorf("Error while getting config: %v", err)
 		return nil, err
 	}
+	oldEnv := GetEnv(h.Logger, config)
 
 	for foreignName, vnfcDepParam := range dependency.VNFCParameters {
 		if config.Foreign == nil {
 			config.Foreign = make(map[string][]map[string]string)
 		}
-		config.Foreign[foreignName] = make([]map[string]string, len(vnfcDepParam.Parameters))
-		x := 0
-		for _, depParam := range vnfcDepParam.Parameters {
-			h.Logger.Debugf("Adding to config.foreign: %s", depParam.Parameters)
-			config.Foreign[foreignName][x] = depParam.Parameters
-			x++
-		}
+		config.Foreign[foreignName] = foreignParameters(h.Logger, vnfcDepParam)
 	}
 
 	for foreignName, depParam := range dependency.Parameters {
@@ -153,56 +284,317 @@ func (h *VnfmImpl) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord, dependen
 		config.Foreign[foreignName] = append(config.Foreign[foreignName], tmpMap)
 	}
 	//h.Logger.Debugf("%s: Foreign Config is: %v", config.Name, config.Foreign)
+	if err := h.applyDependencyChange(ctx, vnfr, &config, oldEnv); err != nil {
+		h.Logger.Errorf("%s: Error while applying the dependency change: %v", config.Name, err)
+		SaveConfig(vnfr.ID, config, h.Logger)
+		return nil, err
+	}
 	SaveConfig(vnfr.ID, config, h.Logger)
 	return vnfr, nil
 }
 
+// applyDependencyChange brings the running containers up to date after the parameters of a
+// dependency changed. Containers whose environment did not change only get the new config files.
+func (h *VnfmImpl) applyDependencyChange(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig, oldEnv []string) error {
+	env := GetEnv(h.Logger, *cfg)
+	running := false
+	for _, ids := range cfg.ContainerIDs {
+		running = running || len(ids) > 0
+	}
+	if !running || !envChanged(oldEnv, env) {
+		return h.reloadConfigFiles(ctx, vnfr, cfg)
+	}
+	if replacesContainers(cfg.OnDependency) {
+		// the new containers get the new config files
+		if _, _, err := cfg.renderConfigFiles(); err != nil {
+			return err
+		}
+		return h.recreateContainers(ctx, vnfr, cfg)
+	}
+	if err := h.reloadConfigFiles(ctx, vnfr, cfg); err != nil {
+		return err
+	}
+	hook := reloadHook(cfg.OnDependency)
+	if hook == nil {
+		h.Logger.Infof("%s: The environment changed, the running containers keep the old one", cfg.Name)
+		return nil
+	}
+	for vduID, ids := range cfg.ContainerIDs {
+		for _, id := range ids {
+			cl, err := getClient(cfg.vimOfContainer(vduID, id), h.CertFolder, h.Tsl)
+			if err != nil {
+				return err
+			}
+			h.Logger.Infof("%s: Running reload hook in container %s", cfg.Name, id)
+			if err := runReloadHook(cl, ctx, id, hook, env); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recreateContainers replaces the containers of the VNFR one at a time with containers having
+// the current environment, on the same vim instance and with the same ips
+func (h *VnfmImpl) recreateContainers(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig) error {
+	secrets, err := resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
+	if err != nil {
+		return err
+	}
+	for _, vdu := range vnfr.VDUs {
+		for _, vnfc := range vdu.VNFCInstances {
+			if vnfc.VCID == "" {
+				continue
+			}
+			if err := h.replaceContainer(ctx, vnfr, cfg, vdu.ID, vnfc, secrets); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceContainer removes the container of the VNFC Instance and starts a new one with the
+// current configuration of the VDU. The new container keeps the name based aliases, the
+// volumes of the VNFC Instance and, where docker allows it, the ips of the old one.
+func (h *VnfmImpl) replaceContainer(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig, vduID string, vnfc *catalogue.VNFCInstance, secrets map[string][]byte) error {
+	vim := cfg.vimOf(vduID, vnfc.VIMID)
+	cl, err := getClient(vim, h.CertFolder, h.Tsl)
+	if err != nil {
+		return err
+	}
+	var ips map[string]string
+	// the container is gone if starting it failed before
+	if vnfc.VCID != "" {
+		h.Logger.Infof("%s: Recreating container %s of VNFC Instance %s", cfg.Name, vnfc.VCID, vnfc.Hostname)
+		ips, err = currentIPs(cl, ctx, vnfc.VCID)
+		if err != nil {
+			h.Logger.Warningf("%s: Unable to get the ips of container %s: %v", cfg.Name, vnfc.VCID, err)
+		}
+		if err := removeContainer(h.Logger, cl, ctx, cfg.Stop, vnfc.VCID, false); err != nil {
+			h.Logger.Warningf("%s: Error while removing container %s: %v", cfg.Name, vnfc.VCID, err)
+		}
+		cfg.ContainerIDs[vduID] = removeString(cfg.ContainerIDs[vduID], vnfc.VCID)
+		delete(cfg.ContainerVim, vnfc.VCID)
+		delete(cfg.Paused, vnfc.VCID)
+		removeContainerReports(vnfr, vnfc.Hostname)
+		vnfc.VCID = ""
+	}
+	id, newIPs, fips, name, err := h.startContainer(ctx, cfg.withIPs(vduID, vnfcScope(vnfc), ips), vduID, vim, firstNet(vnfc), vnfcScope(vnfc), secrets, nil)
+	if err != nil {
+		return err
+	}
+	setVnfcContainer(vnfr, vnfc, cfg.Vdu(vduID).image(), id, name, newIPs, fips)
+	return nil
+}
+
+// reloadConfigFiles copies the config files into the running containers when the rendered
+// content changed and makes them reload it, a restart empties the tmpfs of the secrets
+func (h *VnfmImpl) reloadConfigFiles(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig) error {
+	files, changed, err := cfg.renderConfigFiles()
+	if err != nil || !changed {
+		return err
+	}
+	var secrets map[string][]byte
+	if reload := strings.ToLower(cfg.ConfigReload); reload == "" || reload == "restart" {
+		secrets, err = resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
+		if err != nil {
+			return err
+		}
+	}
+	for vduID, ids := range cfg.ContainerIDs {
+		for _, id := range ids {
+			cl, err := getClient(cfg.vimOfContainer(vduID, id), h.CertFolder, h.Tsl)
+			if err != nil {
+				return err
+			}
+			h.Logger.Infof("%s: Config files changed, reloading container %s", cfg.Name, id)
+			if err := copyConfigFiles(cl, ctx, id, files); err != nil {
+				return err
+			}
+			if err := reloadContainer(cl, ctx, id, cfg.ConfigReload); err != nil {
+				return err
+			}
+			if err := writeSecrets(cl, ctx, id, secrets); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (h *VnfmImpl) Query() error {
 	return nil
 }
 
+// Resume unpauses the container of the VNFC Instance, or all the paused containers of the VNFR
 func (h *VnfmImpl) Resume(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	vcID := ""
+	if vnfcInstance != nil {
+		vcID = vnfcInstance.VCID
+	}
+	if err := h.Unpause(vnfr.ID, vcID); err != nil {
+		h.Logger.Errorf("%s: %v", vnfr.Name, err)
+		return nil, err
+	}
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	h.reportStates(ctx, vnfr, cfg)
 	return vnfr, nil
 }
 
+// reportStates sets the state of the VNFC Instances from their containers, see
+// reportContainerState
+func (h *VnfmImpl) reportStates(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg VnfrConfig) {
+	for _, vdu := range vnfr.VDUs {
+		for _, vnfc := range vdu.VNFCInstances {
+			if vnfc.VCID == "" {
+				continue
+			}
+			cl, err := getClient(cfg.vimOf(vdu.ID, vnfc.VIMID), h.CertFolder, h.Tsl)
+			if err == nil {
+				err = reportContainerState(cl, ctx, vnfr, vnfc)
+			}
+			if err != nil {
+				h.Logger.Warningf("%s: Unable to read the state of container %s: %v", cfg.Name, vnfc.VCID, err)
+			}
+		}
+	}
+}
+
+// Pause freezes the processes of the container vcID, or of all the containers of the VNFR
+func (h *VnfmImpl) Pause(vnfrID, vcID string) error {
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	return h.suspend(ctx, vnfrID, vcID, true)
+}
+
+// Unpause resumes the processes of the paused container vcID, or of all the paused containers
+func (h *VnfmImpl) Unpause(vnfrID, vcID string) error {
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	return h.suspend(ctx, vnfrID, vcID, false)
+}
+
+func (h *VnfmImpl) suspend(ctx context.Context, vnfrID, vcID string, pause bool) error {
+	defer lockVnfr(vnfrID)()
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfrID, &cfg, h.Logger); err != nil {
+		return err
+	}
+	found := false
+	for vduID, ids := range cfg.ContainerIDs {
+		for _, id := range ids {
+			if vcID != "" && id != vcID {
+				continue
+			}
+			found = true
+			if cfg.Paused[id] == pause {
+				continue
+			}
+			cl, err := getClient(cfg.vimOfContainer(vduID, id), h.CertFolder, h.Tsl)
+			if err == nil && pause {
+				err = cl.ContainerPause(ctx, id)
+			} else if err == nil {
+				err = cl.ContainerUnpause(ctx, id)
+			}
+			if err != nil {
+				SaveConfig(vnfrID, cfg, h.Logger)
+				return fmt.Errorf("unable to pause or unpause container %s: %v", id, err)
+			}
+			if pause {
+				cfg.Paused[id] = true
+				h.Logger.Infof("%s: Paused container %s", cfg.Name, id)
+			} else {
+				delete(cfg.Paused, id)
+				h.Logger.Infof("%s: Unpaused container %s", cfg.Name, id)
+			}
+		}
+	}
+	if vcID != "" && !found {
+		return fmt.Errorf("VNFR %s has no container %s", vnfrID, vcID)
+	}
+	return SaveConfig(vnfrID, cfg, h.Logger)
+}
+
 func (h *VnfmImpl) Scale(chosenVimInstance interface{}, scaleInOrOut catalogue.Action, vnfr *catalogue.VirtualNetworkFunctionRecord, component catalogue.Component, scripts interface{}, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, *catalogue.VNFCInstance, error) {
-	//TODO get vim instance
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	var vnfci *catalogue.VNFCInstance
 	switch scaleInOrOut {
 	case catalogue.ActionScaleOut:
+		// a scale in is locked by StopVNFCInstance
+		defer lockVnfr(vnfr.ID)()
 		cfg := VnfrConfig{}
-		getConfig(vnfr.ID, &cfg, h.Logger)
-		//TODO handle the case with multiple VDU!
+		err := getConfig(vnfr.ID, &cfg, h.Logger)
+		if err != nil {
+			h.Logger.Errorf("Error while getting config: %v", err)
+			return nil, nil, err
+		}
 		switch component := component.(type) {
 		case *catalogue.VNFComponent:
 			// Not yet allocated by nfvo
 			h.Logger.Debugf("%s: VNFComponent is %+v", cfg.Name, component)
-			vdu := vnfr.VDUs[0]
-			dockerVimInstance := cfg.VimInstance[vdu.ID]
-			cl, err := getClient(dockerVimInstance, dockerVimInstance.Cert, h.Tsl)
+			vdu := vduOfComponent(vnfr, component)
+			if chosen, ok := chosenVimInstance.(*catalogue.DockerVimInstance); ok && chosen != nil {
+				cfg.addVim(vdu.ID, chosen)
+			}
+			p, err := newPlacement(h.Logger, ctx, cfg.Placement, cfg.vduVims(vdu.ID), h.CertFolder, h.Tsl)
+			if err != nil {
+				h.Logger.Errorf("Error while placing VDU %s: %v", vdu.ID, err)
+				return nil, nil, err
+			}
+			p.resume(cfg.PlacementPos[vdu.ID])
+			dockerVimInstance, err := p.place(placementRequest(cfg, vdu.ID))
+			if err != nil {
+				h.Logger.Errorf("Error while placing VNFC of VDU %s: %v", vdu.ID, err)
+				return nil, nil, err
+			}
+			cfg.PlacementPos[vdu.ID] = p.position()
+			cl, err := getClient(dockerVimInstance, h.CertFolder, h.Tsl)
 			if err != nil {
 				h.Logger.Errorf("%s", err)
 				return nil, nil, err
 			}
-			ips, cps, _, err := GetCPsAndIpsFromFixedIps(cl, component, h.Logger, vnfr, cfg)
-			//vnfci := VNFCInstanceFrom(component, dockerVimInstance.ID)
+			netCfg := make(map[string]NetConf)
+			ips, cps, _, err := GetCPsAndIpsFromFixedIps(cl, ctx, component, h.Logger, vnfr, cfg, netCfg)
+			if err != nil {
+				h.Logger.Errorf("Error while getting CP: %v", err)
+				return nil, nil, err
+			}
 			vnfci = newVnfcInstance(dockerVimInstance, vnfr.Name, component, cps, nil, ips)
-			id, ips2, name, err := h.startContainer(cfg, vdu.ID, firstNet(vnfci))
+			cfg.VnfcNetworks[vnfcScope(vnfci)] = netCfg
+			secrets, err := resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
 			if err != nil {
+				h.Logger.Errorf("%s: %v", cfg.Name, err)
 				return nil, nil, err
 			}
-			i := 0
+			id, ips2, fips, name, err := h.startContainer(ctx, cfg, vdu.ID, dockerVimInstance, firstNet(vnfci), vnfcScope(vnfci), secrets, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			vnfci.FloatingIPs = fips
+			vnfci.IPs = make([]*catalogue.IP, 0, len(ips2))
 			for k, v := range ips2 {
-				vnfci.IPs[i] = &catalogue.IP{
+				vnfci.IPs = append(vnfci.IPs, &catalogue.IP{
 					NetName: k,
 					IP:      v,
-				}
-				i++
+				})
 			}
 			vnfci.VCID = id
 			vnfci.Hostname = name
+			reportImage(vnfr, name, cfg.Vdu(vdu.ID).image())
 			vdu.VNFCInstances = append(vdu.VNFCInstances, vnfci)
-			h.Logger.Debugf("Added VNFCI %v:%v in Container %v", vnfci.Hostname, vnfci.ID, vnfci.VCID)
+			h.Logger.Debugf("Added VNFCI %v:%v in Container %v of VDU %v", vnfci.Hostname, vnfci.ID, vnfci.VCID, vdu.ID)
+			err = SaveConfig(vnfr.ID, cfg, h.Logger)
+			if err != nil {
+				return nil, nil, err
+			}
 		default:
 			return nil, nil, errors.New(fmt.Sprintf("Received type %T but VNFComponent required", component))
 		}
@@ -223,67 +615,67 @@ func (h *VnfmImpl) Scale(chosenVimInstance interface{}, scaleInOrOut catalogue.A
 }
 
 func (h *VnfmImpl) Start(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	cfg := VnfrConfig{}
 	err := getConfig(vnfr.ID, &cfg, h.Logger)
 	if err != nil {
 		h.Logger.Errorf("Error while getting config: %v", err)
 		return nil, err
 	}
+	secrets, err := resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return nil, err
+	}
 	for _, vdu := range vnfr.VDUs {
 		for _, vnfc := range vdu.VNFCInstances {
-			id, ips, name, err := h.startContainer(cfg, vdu.ID, firstNet(vnfc))
+			id, ips, fips, name, err := h.startContainer(ctx, cfg, vdu.ID, cfg.vimOf(vdu.ID, vnfc.VIMID), firstNet(vnfc), vnfcScope(vnfc), secrets, nil)
 			if err != nil {
 				return nil, err
 			}
-			vnfc.VCID = id
-			vnfc.Hostname = name
-			vnfc.IPs = make([]*catalogue.IP, len(ips))
-			i := 0
-			for k, v := range ips {
-				vnfc.IPs[i] = &catalogue.IP{
-					NetName: k,
-					IP:      v,
-				}
-				i++
-			}
+			setVnfcContainer(vnfr, vnfc, cfg.Vdu(vdu.ID).image(), id, name, ips, fips)
 		}
 	}
+	h.reportStates(ctx, vnfr, cfg)
 	SaveConfig(vnfr.ID, cfg, h.Logger)
 	return vnfr, nil
 }
 
-func (h *VnfmImpl) startContainer(cfg VnfrConfig, vduID string, firstNetName string) (string, map[string]string, string, error) {
+func (h *VnfmImpl) startContainer(ctx context.Context, cfg VnfrConfig, vduID string, vim *catalogue.DockerVimInstance, firstNetName, scope string, secrets map[string][]byte, restore *checkpointRestore) (string, map[string]string, []*catalogue.IP, string, error) {
 
-	cl, err := getClient(cfg.VimInstance[vduID], h.CertFolder, h.Tsl)
+	cl, err := getClient(vim, h.CertFolder, h.Tsl)
 	if err != nil {
 		h.Logger.Errorf("Error while getting client: %v", err)
-		return "", nil, "", err
+		return "", nil, nil, "", err
 	}
-	mounts := make([]mount.Mount, len(cfg.Mnts))
-
-	for i, mnt := range cfg.Mnts {
-		split := strings.Split(mnt, ":")
-		readOnly := false
-		if len(split) > 2 {
-			readOnly = split[2] == "ro"
-		}
-		h.Logger.Debugf("%s: Mount  %s --> %s", cfg.Name, split[0], split[1])
-		mounts[i] = mount.Mount{
-			Source:   split[0],
-			Target:   split[1],
-			ReadOnly: readOnly,
-			Type:     mount.TypeBind,
-		}
+	vduCfg := cfg.Vdu(vduID)
+	netCfg := cfg.networkCfg(vduID, scope)
+	err = ensureImage(h.Logger, cl, ctx, vim, vduCfg.image(), cfg.PullPolicy, h.Credentials)
+	if err != nil {
+		h.Logger.Errorf("Error while getting image: %v", err)
+		return "", nil, nil, "", err
+	}
+	files, _, err := cfg.renderConfigFiles()
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return "", nil, nil, "", err
+	}
+	mounts, err := toMounts(h.Logger, cfg, vduCfg.Mnts, scope)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return "", nil, nil, "", err
 	}
 
 	endCfg := make(map[string]*network.EndpointSettings)
-	obNetNames := make(map[string]string, len(cfg.NetworkCfg))
+	obNetNames := make(map[string]string, len(netCfg))
 	i := 0
-	for netId, values := range cfg.NetworkCfg {
+	for netId, values := range netCfg {
 		net, err := cl.NetworkInspect(ctx, netId, types.NetworkInspectOptions{})
 		if err != nil {
 			h.Logger.Errorf("Network with id [%s] not found", netId)
-			return "", nil, "", err
+			return "", nil, nil, "", err
 		}
 		netSplit := strings.Split(net.Name, "_")
 		obNetName := strings.Join(netSplit[:len(netSplit)-1], "")
@@ -310,122 +702,168 @@ func (h *VnfmImpl) startContainer(cfg VnfrConfig, vduID string, firstNetName str
 		EndpointsConfig: firstCfg,
 	}
 
-	portBindings := make(nat.PortMap)
-
-	expPorts := make(nat.PortSet)
-	var pubAllPort = false
-	for _, prts := range cfg.PubPort {
-		pubAllPort = true
-		var portSrc, portTrg nat.Port
-		if len(prts) == 3 {
-			portSrc, err = nat.NewPort(prts[2], prts[0])
-			if err != nil {
-				debug.PrintStack()
-				return "", nil, "", err
-			}
-			portTrg, err = nat.NewPort(prts[2], prts[1])
-			if err != nil {
-				debug.PrintStack()
-				return "", nil, "", err
-			}
-			portBindings[portTrg] = []nat.PortBinding{{
-				HostIP:   "0.0.0.0",
-				HostPort: portSrc.Port(),
-			}}
-		} else if len(prts) == 2 {
-			if prts[1] == "tcp" || prts[1] == "udp" {
-				portTrg, err = nat.NewPort(prts[1], prts[0])
-				if err != nil {
-					debug.PrintStack()
-					return "", nil, "", err
-				}
-				portBindings[portTrg] = []nat.PortBinding{{
-					HostIP: "0.0.0.0",
-					HostPort: portTrg.Port(),
-				},
-				}
-			} else {
-				portSrc, err = nat.NewPort("tcp", prts[0])
-				if err != nil {
-					debug.PrintStack()
-					return "", nil, "", err
-				}
-				portTrg, err = nat.NewPort("tcp", prts[1])
-				if err != nil {
-					debug.PrintStack()
-					return "", nil, "", err
-				}
-				portBindings[portTrg] = []nat.PortBinding{{
-					HostIP:   "0.0.0.0",
-					HostPort: portSrc.Port(),
-				},
-				}
-			}
-		} else {
-			portTrg, err = nat.NewPort("tcp", prts[0])
-			if err != nil {
-				debug.PrintStack()
-				return "", nil, "", err
-			}
-			portBindings[portTrg] = []nat.PortBinding{{
-				HostIP: "0.0.0.0",
-			},
-			}
-		}
-		expPorts[portTrg] = struct{}{}
+	expPorts, portBindings, err := toPortBindings(vduCfg.Ports)
+	if err != nil {
+		debug.PrintStack()
+		return "", nil, nil, "", err
 	}
 	hostCfg := container.HostConfig{
 		DNS:          cfg.DNSs,
-		CapAdd:       []string{"NET_ADMIN", "SYS_ADMIN"},
 		Mounts:       mounts,
 		PortBindings: portBindings,
+		Resources: container.Resources{
+			Memory:   cfg.Memory,
+			NanoCPUs: cfg.NanoCPUs,
+		},
 
-		PublishAllPorts: pubAllPort,
+		// only the ports of the mappings are published
+		PublishAllPorts: false,
+		RestartPolicy:   cfg.Restart.containerPolicy(cfg.RestartPolicy),
 	}
 	envList := GetEnv(h.Logger, cfg)
+	for _, k := range sortedKeys(vduCfg.Own) {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, vduCfg.Own[k]))
+	}
 
-	h.Logger.Noticef("%s: Image: %v", cfg.Name, cfg.ImageName)
+	h.Logger.Noticef("%s: Image: %v (%s)", cfg.Name, vduCfg.ImageName, vduCfg.image())
 
 	config := &container.Config{
-		Image:        cfg.ImageName,
+		Image:        vduCfg.image(),
 		Env:          envList,
 		ExposedPorts: expPorts,
 		Hostname:     cfg.Name,
-		Cmd:          cfg.Cmd,
+		Cmd:          vduCfg.Cmd,
+		Labels:       containerLabels(cfg, vduID),
+		StopSignal:   cfg.Stop.Signal,
+	}
+	if cfg.Stop.GracePeriod > 0 {
+		stopTimeout := int(cfg.Stop.grace().Seconds())
+		config.StopTimeout = &stopTimeout
+	}
+	err = cfg.Security.applyToContainer(config, &hostCfg)
+	if err != nil {
+		return "", nil, nil, "", err
+	}
+	if cfg.Security.ReadOnly {
+		// files can be copied into volumes only, docker fills them with the content of the image
+		for _, dir := range configDirs(files) {
+			hostCfg.Mounts = append(hostCfg.Mounts, mount.Mount{
+				Type:   mount.TypeVolume,
+				Target: dir,
+			})
+		}
+	}
+	if err := checkSecrets(cfg, secrets); err != nil {
+		return "", nil, nil, "", err
+	}
+	if len(secrets) > 0 {
+		hostCfg.Tmpfs = map[string]string{secretsDir: secretsTmpfs}
+	}
+
+	var seed *BackupManifest
+	var seedVolumes []mount.Mount
+	if cfg.RestoreBackup != "" {
+		if h.Backups == nil {
+			return "", nil, nil, "", fmt.Errorf("unable to restore backup %s, backups are not enabled", cfg.RestoreBackup)
+		}
+		seed, err = h.Backups.Get(cfg.RestoreBackup)
+		if err != nil {
+			return "", nil, nil, "", err
+		}
+		// only the volumes created with the container are seeded
+		seedVolumes = newVolumes(cl, ctx, mounts, cfg.generatedDirs())
 	}
 
 	h.Logger.Debugf("NetworkConfig is %+v", networkingConfig)
 
 	resp, err := cl.ContainerCreate(ctx, config, &hostCfg, &networkingConfig, fmt.Sprintf("%s-%d", cfg.Name, randInt(1000, 9999)))
 	if err != nil {
-		return "", nil, "", err
+		return "", nil, nil, "", err
+	}
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		// the deadline of the operation may have expired
+		ctx, cancel := newCleanup()
+		defer cancel()
+		if err := cl.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			h.Logger.Errorf("%s: Unable to remove container %s: %v", cfg.Name, resp.ID, err)
+		}
+	}()
+	// the restored data must not overwrite the files rendered for the new container
+	if seed != nil {
+		if err := h.Backups.seed(cl, ctx, seed, vduID, scope, resp.ID, seedVolumes); err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			return "", nil, nil, "", err
+		}
+	}
+	if err := copyConfigFiles(cl, ctx, resp.ID, files); err != nil {
+		h.Logger.Errorf("%s: Error while copying the config files: %v", cfg.Name, err)
+		return "", nil, nil, "", err
 	}
 
 	options := types.ContainerStartOptions{}
+	if restore != nil {
+		if err := restore.prepare(cl, resp.ID); err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			return "", nil, nil, "", err
+		}
+		options.CheckpointID = restore.ID
+		options.CheckpointDir = restore.Dir
+	}
 	if err := cl.ContainerStart(ctx, resp.ID, options); err != nil {
-		return "", nil, "", err
+		return "", nil, nil, "", err
+	}
+	if err := writeSecrets(cl, ctx, resp.ID, secrets); err != nil {
+		h.Logger.Errorf("%s: Error while writing the secrets: %v", cfg.Name, err)
+		return "", nil, nil, "", err
 	}
 
 	for netName, endpointSettings := range endCfg {
 		h.Logger.Debugf("%v: Adding network %v", cfg.Name, netName)
-		netIds, _ := getNetworkIdsFromNames(cl, []string{netName})
+		netIds, _ := getNetworkIdsFromNames(cl, ctx, []string{netName})
 		err := cl.NetworkConnect(ctx, netIds[0], resp.ID, endpointSettings)
 		if err != nil {
 			h.Logger.Errorf("Error connecting to network: ", err)
 		}
 	}
 
-	go h.readLogsFromContainer(cl, resp.ID, cfg)
-	cfg.ContainerIDs[vduID] = append(cfg.ContainerIDs[vduID], resp.ID)
 	c, err := cl.ContainerInspect(ctx, resp.ID)
 	if err != nil {
-		return "", nil, "", err
+		return "", nil, nil, "", err
 	}
+	started = true
+	go h.readLogsFromContainer(cl, resp.ID, cfg)
+	cfg.ContainerIDs[vduID] = append(cfg.ContainerIDs[vduID], resp.ID)
+	cfg.ContainerVim[resp.ID] = vim.ID
 	ips := make(map[string]string)
 	for netName, cfg := range c.NetworkSettings.Networks {
 		ips[obNetNames[netName]] = cfg.IPAddress
 	}
-	return resp.ID, ips, c.Name[1:], nil
+	fips := publishedPortIPs(c.NetworkSettings.Ports)
+	if len(vduCfg.Ports) > 0 {
+		fips = floatingIPs(externalAddress(vim, h.ExternalAddresses), sortedKeys(ips), fips)
+	}
+	return resp.ID, ips, fips, c.Name[1:], nil
+}
+
+// setVnfcContainer updates the VNFC Instance with the container started for it
+func setVnfcContainer(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfc *catalogue.VNFCInstance, image, id, name string, ips map[string]string, fips []*catalogue.IP) {
+	vnfc.FloatingIPs = fips
+	vnfc.VCID = id
+	vnfc.Hostname = name
+	reportImage(vnfr, name, image)
+	vnfc.IPs = make([]*catalogue.IP, len(ips))
+	i := 0
+	for k, v := range ips {
+		vnfc.IPs[i] = &catalogue.IP{
+			NetName: k,
+			IP:      v,
+		}
+		i++
+	}
 }
 
 func firstNet(vnfc *catalogue.VNFCInstance) string {
@@ -446,6 +884,9 @@ func randInt(min int, max int) int {
 }
 
 func (h *VnfmImpl) readLogsFromContainer(cl *docker.Client, contID string, cfg VnfrConfig) {
+	// the logs are read after the operation starting the container
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	time.Sleep(5 * time.Second)
 	logs, _ := cl.ContainerLogs(ctx, contID, types.ContainerLogsOptions{
 		Details:    false,
@@ -473,32 +914,47 @@ func (h *VnfmImpl) Stop(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogu
 }
 
 func (h *VnfmImpl) StopVNFCInstance(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	h.Logger.Noticef("Stop VNFCInstance %v with ID %v of vnfr: %v", vnfcInstance.Hostname, vnfcInstance.ID, vnfr.Name)
 	cfg := VnfrConfig{}
 	getConfig(vnfr.ID, &cfg, h.Logger)
-	var timeout = 10 * time.Second
 
 	for _, vdu := range vnfr.VDUs {
-		cl, err := getClient(cfg.VimInstance[vdu.ID], h.CertFolder, h.Tsl)
-		if err != nil {
-			h.Logger.Errorf("Error while getting client: %v", err)
-		}
 		for i, vnfc := range vdu.VNFCInstances {
 			if vnfc.ID == vnfcInstance.ID {
+				cl, err := getClient(cfg.vimOf(vdu.ID, vnfc.VIMID), h.CertFolder, h.Tsl)
+				if err != nil {
+					h.Logger.Errorf("Error while getting client: %v", err)
+					return nil, err
+				}
 				h.Logger.Debugf("Removing VNFCI %v:%v with Container %v", vnfc.Hostname, vnfc.ID, vnfcInstance.VCID)
-				cl.ContainerStop(ctx, vnfcInstance.VCID, &timeout)
-				go cl.ContainerRemove(ctx, vnfcInstance.VCID, types.ContainerRemoveOptions{
-					Force: true,
-				})
+				err = removeContainer(h.Logger, cl, ctx, cfg.Stop, vnfcInstance.VCID, cfg.VolumeRetain == VolumesDelete)
+				if err != nil {
+					h.Logger.Errorf("%s: Error while removing container %s: %v", cfg.Name, vnfcInstance.VCID, err)
+					return nil, err
+				}
 				vdu.VNFCInstances = append(vdu.VNFCInstances[:i], vdu.VNFCInstances[i+1:]...)
-				return vnfr, nil
+				cfg.ContainerIDs[vdu.ID] = removeString(cfg.ContainerIDs[vdu.ID], vnfcInstance.VCID)
+				delete(cfg.ContainerVim, vnfcInstance.VCID)
+				delete(cfg.Paused, vnfcInstance.VCID)
+				delete(cfg.VnfcNetworks, vnfcScope(vnfc))
+				removeContainerReports(vnfr, vnfc.Hostname)
+				return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
 			}
 		}
 	}
 	return vnfr, nil
 }
 
+// Terminate stops every container of the VNFR gracefully and waits for its removal. The record
+// of the VNFR is deleted only when all the containers are gone, otherwise the errors are returned
+// and a new terminate retries the remaining ones.
 func (h *VnfmImpl) Terminate(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	h.Logger.Noticef("Remove container for vnfr: %v", vnfr.Name)
 	cfg := &VnfrConfig{}
 	err := getConfig(vnfr.ID, cfg, h.Logger)
@@ -507,34 +963,201 @@ func (h *VnfmImpl) Terminate(vnfr *catalogue.VirtualNetworkFunctionRecord) (*cat
 		h.Logger.Errorf("Probably not found")
 		return vnfr, nil
 	}
-	for _, vdu := range vnfr.VDUs {
-		cl, err := getClient(cfg.VimInstance[vdu.ID], h.CertFolder, h.Tsl)
-		if err != nil {
-			h.Logger.Errorf("Error while getting client: %v", err)
-			return nil, err
-		}
-		var timeout = 10 * time.Second
-		for _, ids := range cfg.ContainerIDs {
-			for _, id := range ids {
-				cl.ContainerStop(ctx, id, &timeout)
-				go cl.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
-					Force: true,
-				})
+	errs := make([]string, 0)
+	networks := make(map[string][]string)
+	own := make([]string, 0)
+	for _, ids := range cfg.ContainerIDs {
+		own = append(own, ids...)
+	}
+	for vduID, ids := range cfg.ContainerIDs {
+		for _, id := range ids {
+			vim := cfg.vimOfContainer(vduID, id)
+			cl, err := getClient(vim, h.CertFolder, h.Tsl)
+			if err == nil {
+				if cfg.NetworkRetain == NetworksDelete {
+					networks[vim.ID] = append(networks[vim.ID], ownedNetworks(cl, ctx, id, own)...)
+				}
+				err = removeContainer(h.Logger, cl, ctx, cfg.Stop, id, cfg.VolumeRetain == VolumesDelete)
+			}
+			if err != nil {
+				h.Logger.Errorf("%s: Error while removing container %s: %v", cfg.Name, id, err)
+				errs = append(errs, fmt.Sprintf("container %s: %v", id, err))
+				continue
 			}
+			cfg.ContainerIDs[vduID] = removeString(cfg.ContainerIDs[vduID], id)
+			delete(cfg.ContainerVim, id)
 		}
 	}
+	for _, vim := range cfg.Vims {
+		if cfg.VolumeRetain != VolumesDelete && len(networks[vim.ID]) == 0 {
+			continue
+		}
+		cl, err := getClient(vim, h.CertFolder, h.Tsl)
+		if err == nil && cfg.VolumeRetain == VolumesDelete {
+			err = removeVolumes(h.Logger, cl, ctx, vnfr.ID)
+		}
+		if err == nil {
+			err = removeNetworks(h.Logger, cl, ctx, networks[vim.ID])
+		}
+		if err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		SaveConfig(vnfr.ID, *cfg, h.Logger)
+		return nil, fmt.Errorf("unable to terminate VNFR %s: %s", vnfr.Name, strings.Join(errs, "; "))
+	}
 	deleteConfig(vnfr.ID)
 	return vnfr, nil
 }
 
+// UpdateSoftware upgrades the image of the VDUs listed in the payload of the script, see
+// imageUpdates. The containers are replaced one at a time, if one of them does not get healthy
+// the VDU is rolled back to its previous image according to update_failure_action.
 func (h *VnfmImpl) UpdateSoftware(script *catalogue.Script, vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
-	return vnfr, nil
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	cfg := VnfrConfig{}
+	err := getConfig(vnfr.ID, &cfg, h.Logger)
+	if err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	images, err := imageUpdates(vnfr, script)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return nil, err
+	}
+	secrets, err := resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		image, ok := images[vdu.ID]
+		if !ok {
+			continue
+		}
+		if err := h.upgradeVdu(ctx, vnfr, &cfg, vdu, image, secrets); err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			SaveConfig(vnfr.ID, cfg, h.Logger)
+			return nil, err
+		}
+	}
+	return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
 }
 
-func (h *VnfmImpl) UpgradeSoftware() error {
+// upgradeVdu replaces the containers of the VDU with containers of the new image
+func (h *VnfmImpl) upgradeVdu(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig, vdu *catalogue.VirtualDeploymentUnit, image string, secrets map[string][]byte) error {
+	policy := cfg.Update.withDefaults()
+	old := cfg.Vdu(vdu.ID)
+	image = withTag(old.ImageName, image)
+	if _, err := h.Policy.allowed(vnfr.ProjectID, []string{image}); err != nil {
+		return err
+	}
+	// the image is made available on every vim instance before replacing any container
+	var digest string
+	for _, vnfc := range vdu.VNFCInstances {
+		vim := cfg.vimOf(vdu.ID, vnfc.VIMID)
+		cl, err := getClient(vim, h.CertFolder, h.Tsl)
+		if err != nil {
+			return err
+		}
+		if digest == "" {
+			if err = ensureImage(h.Logger, cl, ctx, vim, image, cfg.PullPolicy, h.Credentials); err == nil {
+				digest, err = pinImage(h.Logger, cl, ctx, vim, image, h.Credentials)
+			}
+			if err == nil {
+				err = h.Policy.verify(vnfr.ProjectID, digest)
+			}
+		} else {
+			err = ensureImage(h.Logger, cl, ctx, vim, digest, cfg.PullPolicy, h.Credentials)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	change := ImageChange{VduID: vdu.ID, From: old.image(), To: digest}
+	if digest == "" || digest == old.image() {
+		h.Logger.Infof("%s: VDU %s already runs image %s", cfg.Name, vdu.ID, old.image())
+		return nil
+	}
+	h.Logger.Noticef("%s: Upgrading VDU %s from %s to %s", cfg.Name, vdu.ID, old.image(), digest)
+	setImage := func(name, digest string) {
+		cfg.setVdu(vdu.ID, func(vc *VduConfig) {
+			vc.ImageName = name
+			vc.ImageDigest = digest
+		})
+	}
+	setImage(image, digest)
+	replaced := make([]*catalogue.VNFCInstance, 0, len(vdu.VNFCInstances))
+	failed := make([]string, 0)
+	for _, vnfc := range vdu.VNFCInstances {
+		if vnfc.VCID == "" {
+			continue
+		}
+		var err error
+		if len(replaced) > 0 && policy.Delay > 0 {
+			if err = sleep(ctx, policy.Delay); err != nil {
+				err = fmt.Errorf("upgrade interrupted: %v", err)
+			}
+		}
+		if err == nil {
+			replaced = append(replaced, vnfc)
+			err = h.replaceContainer(ctx, vnfr, cfg, vdu.ID, vnfc, secrets)
+		}
+		if err == nil {
+			var cl *docker.Client
+			cl, err = getClient(cfg.vimOf(vdu.ID, vnfc.VIMID), h.CertFolder, h.Tsl)
+			if err == nil {
+				err = waitHealthy(cl, ctx, vnfc.VCID, policy.Monitor, policy.Timeout)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		h.Logger.Errorf("%s: Upgrade of VNFC Instance %s failed: %v", cfg.Name, vnfc.Hostname, err)
+		switch {
+		case policy.FailureAction == UpdateContinue && ctx.Err() == nil:
+			failed = append(failed, fmt.Sprintf("%s: %v", vnfc.Hostname, err))
+			continue
+		case policy.FailureAction == UpdatePause:
+			change.Result = ImagePaused
+			cfg.addImageChange(change, err)
+			return fmt.Errorf("upgrade of VDU %s to %s paused: %v", vdu.ID, digest, err)
+		}
+		setImage(old.ImageName, old.ImageDigest)
+		// the operation may have run out of time, the rollback gets its own deadline
+		rollbackCtx, cancel := newOperation(h.Timeout)
+		defer cancel()
+		for _, done := range replaced {
+			if rerr := h.replaceContainer(rollbackCtx, vnfr, cfg, vdu.ID, done, secrets); rerr != nil {
+				h.Logger.Errorf("%s: Rollback of VNFC Instance %s failed: %v", cfg.Name, done.Hostname, rerr)
+			}
+		}
+		change.Result = ImageRolledBack
+		cfg.addImageChange(change, err)
+		return fmt.Errorf("upgrade of VDU %s to %s rolled back to %s: %v", vdu.ID, digest, old.image(), err)
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("upgrade of VDU %s to %s failed on %d of %d VNFC Instances: %s", vdu.ID, digest, len(failed), len(replaced), strings.Join(failed, "; "))
+		change.Result = ImagePartial
+		cfg.addImageChange(change, err)
+		return err
+	}
+	change.Result = ImageUpgraded
+	cfg.addImageChange(change, nil)
 	return nil
 }
 
+// UpgradeSoftware does not receive the VNFR nor the new image, images are upgraded by
+// UpdateSoftware
+func (h *VnfmImpl) UpgradeSoftware() error {
+	return errors.New("upgrade the image with UpdateSoftware and a script containing the new image")
+}
+
 func (h *VnfmImpl) UserData() string {
 	return ""
 }
@@ -2,29 +2,67 @@ package handler
 
 import (
 	"bufio"
+	"context"
 	"docker.io/go-docker"
 	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/swarm"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/openbaton/go-openbaton/catalogue"
-	"math/rand"
 	"runtime/debug"
+	"strings"
+	"time"
 )
 
 type VnfmSwarmHandler struct {
-	Logger     *logging.Logger
-	Tsl        bool
-	CertFolder string
+	Logger            *logging.Logger
+	Tsl               bool
+	CertFolder        string
+	ExternalAddresses map[string]string
+	Credentials       *RegistryCredentials
+	Policy            *ImagePolicy
+	Security          SecurityProfile
+	Secrets           SecretSource
+	Timeout           time.Duration
 }
 
+// ActionForResume returns ActionResume if the service of the VNFC Instance, or any service of
+// the VNFR, was paused by the VNFM and ActionStart if it was never started
 func (h *VnfmSwarmHandler) ActionForResume(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance) catalogue.Action {
-	return catalogue.NoActionSpecified
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		return catalogue.NoActionSpecified
+	}
+	action := catalogue.NoActionSpecified
+	for _, vdu := range vnfr.VDUs {
+		if vnfcInstance != nil && !containsVnfc(vdu, vnfcInstance) {
+			continue
+		}
+		if cfg.Paused[vdu.ID] {
+			return catalogue.ActionResume
+		}
+		if service, ok := cfg.VduService[vdu.ID]; ok && !serviceStarted(service) {
+			action = catalogue.ActionStart
+		}
+	}
+	return action
 }
 
-func (h *VnfmSwarmHandler) CheckInstantiationFeasibility() error {
+// containsVnfc returns true if the VNFC Instance belongs to the VDU
+func containsVnfc(vdu *catalogue.VirtualDeploymentUnit, vnfcInstance *catalogue.VNFCInstance) bool {
+	for _, vnfc := range vdu.VNFCInstances {
+		if vnfc == vnfcInstance || (vnfcInstance.ID != "" && vnfc.ID == vnfcInstance.ID) {
+			return true
+		}
+	}
+	return false
+}
 
+// CheckInstantiationFeasibility does not receive the VNFR nor the vim instances, the feasibility
+// of a deployment is checked at the beginning of Instantiate by checkFeasibility
+func (h *VnfmSwarmHandler) CheckInstantiationFeasibility() error {
 	return nil
 }
 
@@ -37,30 +75,81 @@ func (h *VnfmSwarmHandler) HandleError(vnfr *catalogue.VirtualNetworkFunctionRec
 	return nil
 }
 
+// Heal does not migrate the tasks of a service, swarm moves them when their node is drained
 func (h *VnfmSwarmHandler) Heal(vnfr *catalogue.VirtualNetworkFunctionRecord, component *catalogue.VNFCInstance, cause string) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	if _, _, ok := parseMigration(cause); ok {
+		return nil, errors.New("the tasks of swarm services are migrated by draining their node")
+	}
 	return vnfr, nil
 }
 
 func (h *VnfmSwarmHandler) Instantiate(vnfr *catalogue.VirtualNetworkFunctionRecord, scripts interface{}, vimInstances map[string][]interface{}) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	if vnfr.VDUs == nil {
 		return nil, errors.New("no VDU provided")
 	}
 	config := NewVnfrConfig(vnfr)
-	aliases := FillConfig(vnfr, &config, h.Logger)
+	config.Security = h.Security.clone()
+	aliases, err := FillConfig(vnfr, &config, h.Logger)
+	if err != nil {
+		h.Logger.Errorf("Error while reading configuration: %v", err)
+		return nil, err
+	}
+	err = config.loadTemplates(vnfr, scripts)
+	if err != nil {
+		h.Logger.Errorf("Error while reading the config files: %v", err)
+		return nil, err
+	}
+	if config.RestoreBackup != "" {
+		h.Logger.Warningf("%s: Volumes of swarm services can not be seeded from backup %s", vnfr.Name, config.RestoreBackup)
+	}
+	suitable, err := checkFeasibility(h.Logger, ctx, vnfr, config, vimInstances, h.CertFolder, h.Tsl, true, h.Credentials)
+	if err != nil {
+		return nil, err
+	}
 
 	config.NetworkCfg = make(map[string]NetConf)
 
-	pubPorts := make([]string, 0)
+	secrets, err := resolveSecrets(h.Secrets, vnfr, config.Secrets)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", vnfr.Name, err)
+		return nil, err
+	}
+	secretRefs := make(map[string][]*swarm.SecretReference)
+	files, _, err := config.renderConfigFiles()
+	if err != nil {
+		h.Logger.Errorf("%s: %v", vnfr.Name, err)
+		return nil, err
+	}
+	configRefs := make(map[string][]*swarm.ConfigReference)
 
-	for _, ps := range config.PubPort {
-		pubPorts = append(pubPorts, ps[0], ps[1])
+	ports, err := toSwarmPorts(config.Ports, config.PublishMode)
+	if err != nil {
+		h.Logger.Errorf("Error: %v", err)
+		return nil, err
 	}
 
 	for _, vdu := range vnfr.VDUs {
 		vdu.VNFCInstances = make([]*catalogue.VNFCInstance, 0)
-		vimInstanceChosen := vimInstances[vdu.ParentVDU][rand.Intn(len(vimInstances[vdu.ParentVDU]))]
-		dockerVimInstance := vimInstanceChosen.(*catalogue.DockerVimInstance)
+		candidates := dockerVimInstances(vimInstances[vdu.ParentVDU])
+		if len(candidates) == 0 {
+			return nil, errors.New(fmt.Sprintf("no Docker Vim Instance provided for VDU %s", vdu.ID))
+		}
+		// the swarm schedules the tasks, the placement chooses only the swarm of the service
+		p, err := newPlacement(h.Logger, ctx, config.Placement, suitable[vdu.ID], h.CertFolder, h.Tsl)
+		if err != nil {
+			h.Logger.Errorf("Error while placing VDU %s: %v", vdu.ID, err)
+			return nil, err
+		}
+		dockerVimInstance, err := p.place(placementRequest(config, vdu.ID))
+		if err != nil {
+			h.Logger.Errorf("Error while placing VDU %s: %v", vdu.ID, err)
+			return nil, err
+		}
 		config.VimInstance[vdu.ID] = dockerVimInstance
+		config.addVim(vdu.ID, dockerVimInstance)
 
 		h.Logger.Debugf("%v VNF has %v VNFC(s)", vnfr.Name, len(vdu.VNFCs))
 		cli, err := getClient(dockerVimInstance, h.CertFolder, h.Tsl)
@@ -68,44 +157,94 @@ func (h *VnfmSwarmHandler) Instantiate(vnfr *catalogue.VirtualNetworkFunctionRec
 			h.Logger.Errorf("Error: %v", err)
 			return nil, err
 		}
-		_, cps, netNames, err := GetCPsAndIpsFromFixedIps(cli, vdu.VNFCs[0], h.Logger, vnfr, config)
+		_, cps, netNames, err := GetCPsAndIpsFromFixedIps(cli, ctx, vdu.VNFCs[0], h.Logger, vnfr, config, config.NetworkCfg)
 		if err != nil {
 			h.Logger.Errorf("Error: %v", err)
 			return nil, err
 		}
-		imageChosen, err := chooseImage(vdu, dockerVimInstance)
+		images, err := h.Policy.allowed(vnfr.ProjectID, vdu.VMImages)
+		if err != nil {
+			h.Logger.Errorf("%v", err)
+			return nil, err
+		}
+		imageChosen, err := chooseServiceImage(cli, ctx, dockerVimInstance, images, config.PullPolicy, h.Credentials)
 		if err != nil {
 			debug.PrintStack()
 			return nil, err
 		}
-		config.ImageName = imageChosen
+		registryAuth, err := h.Credentials.auth(dockerVimInstance, imageChosen)
+		if err != nil {
+			h.Logger.Errorf("Error: %v", err)
+			return nil, err
+		}
+		// the tasks are started later by the nodes, they must not see a different image
+		imageDigest, err := pinImage(h.Logger, cli, ctx, dockerVimInstance, imageChosen, h.Credentials)
+		if err != nil {
+			h.Logger.Errorf("Error: %v", err)
+			return nil, err
+		}
+		err = h.Policy.verify(vnfr.ProjectID, imageDigest)
+		if err != nil {
+			h.Logger.Errorf("%v", err)
+			return nil, err
+		}
+		config.setVdu(vdu.ID, func(vc *VduConfig) {
+			vc.ImageName = imageChosen
+			vc.ImageDigest = imageDigest
+		})
 		// Starting service
 		if config.BaseHostname == "" {
 			config.BaseHostname = fmt.Sprintf("%s", vnfr.Name)
 		}
 
-		netIds, err := getNetworkIdsFromNames(cli, netNames)
+		netIds, err := getNetworkIdsFromNames(cli, ctx, netNames)
 		if err != nil {
 			h.Logger.Errorf("Error: %v", err)
 			return nil, err
 		}
-		srv, err := createService(h.Logger, cli, ctx, 0, config.ImageName, config.BaseHostname, config.Cmd, netIds, pubPorts, config.Constraints, aliases)
+		if _, ok := secretRefs[dockerVimInstance.ID]; !ok {
+			secretRefs[dockerVimInstance.ID], err = createSecrets(cli, ctx, &config, dockerVimInstance, secrets)
+			if err != nil {
+				h.Logger.Errorf("Error while creating the secrets: %v", err)
+				return nil, err
+			}
+			configRefs[dockerVimInstance.ID], err = createConfigs(cli, ctx, &config, dockerVimInstance, files)
+			if err != nil {
+				h.Logger.Errorf("Error while creating the configs: %v", err)
+				return nil, err
+			}
+		}
+		srv, err := createService(h.Logger, cli, ctx, config.Scheduling.serviceMode(0), config.Vdu(vdu.ID).image(), config.BaseHostname, config.Cmd, netIds, ports, config.Scheduling.placement(config.Constraints), config.Security, config.Stop, config.Restart.swarmPolicy(config.RestartPolicy), config.Update, secretRefs[dockerVimInstance.ID], configRefs[dockerVimInstance.ID], registryAuth, aliases)
 		if err != nil {
 			debug.PrintStack()
 			h.Logger.Errorf("Error: %v", err)
 			return nil, err
 		}
 
-		ips, fips, err := GetIpsFromService(cli, h.Logger, &config, vnfr, srv)
+		ips, fips, err := GetIpsFromService(cli, ctx, h.Logger, &config, vnfr, srv)
+		if err != nil {
+			h.Logger.Errorf("Error: %v", err)
+			return nil, err
+		}
 
+		// the VNFC Instances get the ips of their tasks when the service is started
+		config.setServiceIPs(vnfr, vdu.ID, srv.Spec.Name, ips)
 		SetupVNFCInstance(vdu, dockerVimInstance, config.BaseHostname, cps, fips, ips)
+		reportImage(vnfr, config.BaseHostname, config.Vdu(vdu.ID).image())
+		if len(ports) > 0 {
+			addrs := serviceAddresses(cli, ctx, dockerVimInstance, h.ExternalAddresses)
+			h.Logger.Debugf("%s: Published ports are reachable on %v", vnfr.Name, addrs)
+			for i, vnfc := range vdu.VNFCInstances {
+				vnfc.FloatingIPs = floatingIPs(addrs[i%len(addrs)], netNamesOf(ips), fips)
+			}
+		}
 
 		config.Name = vnfr.Name
 
 		config.VduService[vdu.ID] = *srv
 	}
 
-	err := SaveConfig(vnfr.ID, config, h.Logger)
+	err = SaveConfig(vnfr.ID, config, h.Logger)
 	if err != nil {
 		h.Logger.Errorf("Error: %v", err)
 		return nil, err
@@ -114,6 +253,9 @@ func (h *VnfmSwarmHandler) Instantiate(vnfr *catalogue.VirtualNetworkFunctionRec
 }
 
 func (h *VnfmSwarmHandler) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	js, _ := json.Marshal(dependency)
 	h.Logger.Debugf("DepencencyRecord is: %s", string(js))
 	config := VnfrConfig{}
@@ -122,18 +264,13 @@ func (h *VnfmSwarmHandler) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord,
 		h.Logger.Errorf("Error while getting config: %v", err)
 		return nil, err
 	}
+	oldEnv := GetEnv(h.Logger, config)
 
 	for foreignName, vnfcDepParam := range dependency.VNFCParameters {
 		if config.Foreign == nil {
 			config.Foreign = make(map[string][]map[string]string)
 		}
-		config.Foreign[foreignName] = make([]map[string]string, len(vnfcDepParam.Parameters))
-		x := 0
-		for _, depParam := range vnfcDepParam.Parameters {
-			h.Logger.Debugf("Adding to config.foreign: %s", depParam.Parameters)
-			config.Foreign[foreignName][x] = depParam.Parameters
-			x++
-		}
+		config.Foreign[foreignName] = foreignParameters(h.Logger, vnfcDepParam)
 	}
 
 	for foreignName, depParam := range dependency.Parameters {
@@ -146,23 +283,274 @@ func (h *VnfmSwarmHandler) Modify(vnfr *catalogue.VirtualNetworkFunctionRecord,
 		config.Foreign[foreignName] = append(config.Foreign[foreignName], tmpMap)
 	}
 	h.Logger.Debugf("%s: Foreign Config is: %v", config.Name, config.Foreign)
+	if err := h.applyDependencyChange(ctx, &config, oldEnv); err != nil {
+		h.Logger.Errorf("%s: Error while applying the dependency change: %v", config.Name, err)
+		SaveConfig(vnfr.ID, config, h.Logger)
+		return nil, err
+	}
 	SaveConfig(vnfr.ID, config, h.Logger)
 	return vnfr, nil
 }
 
+// applyDependencyChange updates the services after the parameters of a dependency changed. The
+// configs are replaced when the rendered files changed, the environment of started services is
+// replaced with a rolling update or reloaded by a hook according to on_dependency_change.
+func (h *VnfmSwarmHandler) applyDependencyChange(ctx context.Context, cfg *VnfrConfig, oldEnv []string) error {
+	env := GetEnv(h.Logger, *cfg)
+	changedEnv := envChanged(oldEnv, env)
+	files, changedFiles, err := cfg.renderConfigFiles()
+	if err != nil {
+		return err
+	}
+	if !changedEnv && !changedFiles {
+		h.Logger.Debugf("%s: The dependency change does not affect the services", cfg.Name)
+		return nil
+	}
+	oldIDs := make(map[string]string)
+	if changedFiles {
+		for id, vimID := range cfg.ConfigIDs {
+			oldIDs[id] = vimID
+		}
+	}
+	refs := make(map[string][]*swarm.ConfigReference)
+	for vduID, service := range cfg.VduService {
+		vim := cfg.VimInstance[vduID]
+		cli, err := getClient(vim, h.CertFolder, h.Tsl)
+		if err != nil {
+			return err
+		}
+		if _, ok := refs[vim.ID]; changedFiles && !ok {
+			refs[vim.ID], err = createConfigs(cli, ctx, cfg, vim, files)
+			if err != nil {
+				return err
+			}
+		}
+		// services not started yet get the environment when they start, the tasks of paused
+		// services are created again on resume
+		started := serviceStarted(service)
+		updateEnv := changedEnv && (cfg.Paused[vduID] || started && replacesContainers(cfg.OnDependency))
+		if changedFiles || updateEnv {
+			registryAuth, err := h.Credentials.auth(vim, service.Spec.TaskTemplate.ContainerSpec.Image)
+			if err != nil {
+				return err
+			}
+			h.Logger.Infof("%s: Updating service %s after a dependency change", cfg.Name, service.Spec.Name)
+			err = patchService(cli, ctx, &service, registryAuth, func(spec *swarm.ServiceSpec) {
+				if changedFiles {
+					spec.TaskTemplate.ContainerSpec.Configs = refs[vim.ID]
+				}
+				if updateEnv {
+					spec.TaskTemplate.ContainerSpec.Env = env
+				}
+			})
+			if err != nil {
+				return err
+			}
+			cfg.VduService[vduID] = service
+		}
+		if hook := reloadHook(cfg.OnDependency); changedEnv && started && hook != nil {
+			h.runServiceHook(cli, ctx, cfg, service, hook, env)
+		} else if changedEnv && started && !updateEnv {
+			h.Logger.Infof("%s: The environment changed, the tasks of service %s keep the old one", cfg.Name, service.Spec.Name)
+		}
+	}
+	for configID, vimID := range oldIDs {
+		cli, err := getClient(cfg.Vims[vimID], h.CertFolder, h.Tsl)
+		if err == nil {
+			err = cli.ConfigRemove(ctx, configID)
+		}
+		if err != nil && !docker.IsErrNotFound(err) {
+			// the config is kept to be removed by the next change or the terminate
+			h.Logger.Warningf("%s: Unable to remove the old config %s: %v", cfg.Name, configID, err)
+			continue
+		}
+		delete(cfg.ConfigIDs, configID)
+	}
+	return nil
+}
+
+// runServiceHook executes the hook in the running tasks of the service. Only the containers
+// of the node the VNFM is connected to can be reached, the other ones are logged.
+func (h *VnfmSwarmHandler) runServiceHook(cli *docker.Client, ctx context.Context, cfg *VnfrConfig, service swarm.Service, hook, env []string) {
+	tasks, err := runningTasks(cli, ctx, service.ID)
+	if err != nil {
+		h.Logger.Errorf("%s: Unable to list the tasks of service %s: %v", cfg.Name, service.Spec.Name, err)
+		return
+	}
+	for _, task := range tasks {
+		containerID := task.Status.ContainerStatus.ContainerID
+		h.Logger.Infof("%s: Running hook %v in task %s", cfg.Name, hook, task.ID)
+		if err := runReloadHook(cli, ctx, containerID, hook, env); err != nil {
+			h.Logger.Warningf("%s: Hook failed in task %s on node %s: %v", cfg.Name, task.ID, task.NodeID, err)
+		}
+	}
+}
+
+// serviceStarted returns false for a replicated service without replicas
+func serviceStarted(service swarm.Service) bool {
+	replicated := service.Spec.Mode.Replicated
+	return replicated == nil || replicated.Replicas == nil || *replicated.Replicas > 0
+}
+
 func (h *VnfmSwarmHandler) Query() error {
 	return nil
 }
 
+// Resume restores the replicas of the paused services, the tasks of a service are paused and
+// resumed together
 func (h *VnfmSwarmHandler) Resume(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	if err := h.Unpause(vnfr.ID, ""); err != nil {
+		h.Logger.Errorf("%s: %v", vnfr.Name, err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		for _, vnfc := range vdu.VNFCInstances {
+			vnfc.State = "ACTIVE"
+		}
+	}
 	return vnfr, nil
 }
 
+// Pause scales the services of the VNFR to zero, remembering their replicas
+func (h *VnfmSwarmHandler) Pause(vnfrID, vcID string) error {
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	if vcID != "" {
+		return errors.New("the tasks of a swarm service can not be paused one by one")
+	}
+	return h.suspend(ctx, vnfrID, true)
+}
+
+// Unpause scales the paused services of the VNFR back to their replicas
+func (h *VnfmSwarmHandler) Unpause(vnfrID, vcID string) error {
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	return h.suspend(ctx, vnfrID, false)
+}
+
+func (h *VnfmSwarmHandler) suspend(ctx context.Context, vnfrID string, pause bool) error {
+	defer lockVnfr(vnfrID)()
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfrID, &cfg, h.Logger); err != nil {
+		return err
+	}
+	for vduID, service := range cfg.VduService {
+		if cfg.Paused[vduID] == pause {
+			continue
+		}
+		if _, stopped := cfg.Replicas[vduID]; pause && (stopped || h.skipGlobal(&cfg, service)) {
+			continue
+		}
+		var err error
+		if pause {
+			err = h.scaleDown(ctx, &cfg, vduID)
+		} else {
+			err = h.scaleUp(ctx, &cfg, vduID)
+		}
+		if err != nil {
+			SaveConfig(vnfrID, cfg, h.Logger)
+			return err
+		}
+		if pause {
+			cfg.Paused[vduID] = true
+			h.Logger.Infof("%s: Paused service %s with %d replicas", cfg.Name, service.Spec.Name, cfg.Replicas[vduID])
+		} else {
+			h.Logger.Infof("%s: Resumed service %s", cfg.Name, service.Spec.Name)
+		}
+	}
+	return SaveConfig(vnfrID, cfg, h.Logger)
+}
+
+// serviceClient returns the client of the vim instance of the VDU and the registry auth of the
+// image of its service
+func (h *VnfmSwarmHandler) serviceClient(cfg *VnfrConfig, vduID string) (*docker.Client, string, error) {
+	vim := cfg.VimInstance[vduID]
+	cli, err := getClient(vim, h.CertFolder, h.Tsl)
+	if err != nil {
+		return nil, "", err
+	}
+	registryAuth, err := h.Credentials.auth(vim, cfg.VduService[vduID].Spec.TaskTemplate.ContainerSpec.Image)
+	if err != nil {
+		return nil, "", err
+	}
+	return cli, registryAuth, nil
+}
+
+// scaleDown scales the service of the VDU to zero keeping its spec and remembers its replicas,
+// a service already scaled down is left as it is. Swarm can not change the mode of a service,
+// the global ones are skipped by the callers, see skipGlobal.
+func (h *VnfmSwarmHandler) scaleDown(ctx context.Context, cfg *VnfrConfig, vduID string) error {
+	if _, ok := cfg.Replicas[vduID]; ok {
+		return nil
+	}
+	service := cfg.VduService[vduID]
+	if service.Spec.Mode.Replicated == nil {
+		return fmt.Errorf("service %s is not replicated and can not be scaled to zero", service.Spec.Name)
+	}
+	var replicas uint64
+	if service.Spec.Mode.Replicated.Replicas != nil {
+		replicas = *service.Spec.Mode.Replicated.Replicas
+	}
+	cli, registryAuth, err := h.serviceClient(cfg, vduID)
+	if err != nil {
+		return err
+	}
+	if err := scaleService(cli, ctx, &service, 0, registryAuth); err != nil {
+		return fmt.Errorf("unable to scale service %s: %v", service.Spec.Name, err)
+	}
+	cfg.VduService[vduID] = service
+	cfg.Replicas[vduID] = replicas
+	return nil
+}
+
+// skipGlobal returns true for a global service, which runs a task on every node until it is
+// removed and can not be stopped nor paused
+func (h *VnfmSwarmHandler) skipGlobal(cfg *VnfrConfig, service swarm.Service) bool {
+	if service.Spec.Mode.Global == nil {
+		return false
+	}
+	h.Logger.Warningf("%s: Service %s is global, its tasks keep running", cfg.Name, service.Spec.Name)
+	return true
+}
+
+// scaleUp restores the replicas of the service of the VDU remembered by scaleDown
+func (h *VnfmSwarmHandler) scaleUp(ctx context.Context, cfg *VnfrConfig, vduID string) error {
+	replicas, ok := cfg.Replicas[vduID]
+	if !ok {
+		return nil
+	}
+	service := cfg.VduService[vduID]
+	cli, registryAuth, err := h.serviceClient(cfg, vduID)
+	if err != nil {
+		return err
+	}
+	if err := scaleService(cli, ctx, &service, replicas, registryAuth); err != nil {
+		return fmt.Errorf("unable to scale service %s: %v", service.Spec.Name, err)
+	}
+	cfg.VduService[vduID] = service
+	delete(cfg.Replicas, vduID)
+	delete(cfg.Paused, vduID)
+	return nil
+}
+
+// scaleService sets the replicas of a replicated service keeping the rest of its spec
+func scaleService(cli *docker.Client, ctx context.Context, service *swarm.Service, replicas uint64, registryAuth string) error {
+	return patchService(cli, ctx, service, registryAuth, func(spec *swarm.ServiceSpec) {
+		spec.Mode.Replicated.Replicas = &replicas
+	})
+}
+
 func (h *VnfmSwarmHandler) Scale(chosenVimInstance interface{}, scaleInOrOut catalogue.Action, vnfr *catalogue.VirtualNetworkFunctionRecord, component catalogue.Component, scripts interface{}, dependency *catalogue.VNFRecordDependency) (*catalogue.VirtualNetworkFunctionRecord, *catalogue.VNFCInstance, error) {
 	return vnfr, nil, nil
 }
 
+// Start creates the tasks of the services, with one replica per VNFC Instance, or restores the
+// replicas of the services stopped or paused. The VNFC Instances are bound to the slots of the
+// tasks. A service failing to start does not stop the others, the start fails with all the errors.
 func (h *VnfmSwarmHandler) Start(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	cfg := VnfrConfig{}
 	err := getConfig(vnfr.ID, &cfg, h.Logger)
 	if err != nil {
@@ -170,28 +558,55 @@ func (h *VnfmSwarmHandler) Start(vnfr *catalogue.VirtualNetworkFunctionRecord) (
 		return nil, err
 	}
 	//resp, err := h.dockerStartContainer(cfg)
+	errs := make([]string, 0)
 	for _, vdu := range vnfr.VDUs {
 		cli, err := getClient(cfg.VimInstance[vdu.ID], h.CertFolder, h.Tsl)
 		if err != nil {
 			h.Logger.Errorf("Error while getting Client: %v", err)
 			return nil, err
 		}
-		var vnfcCount uint64
-		for _, vdu := range vnfr.VDUs {
-			vnfcCount += uint64(len(vdu.VNFCs))
+		replicas, stopped := cfg.Replicas[vdu.ID]
+		if !stopped {
+			replicas = uint64(len(vdu.VNFCInstances))
+		}
+		if stopped {
+			err = h.scaleUp(ctx, &cfg, vdu.ID)
+		} else {
+			service := cfg.VduService[vdu.ID]
+			registryAuth, aerr := h.Credentials.auth(cfg.VimInstance[vdu.ID], service.Spec.TaskTemplate.ContainerSpec.Image)
+			if aerr != nil {
+				h.Logger.Errorf("Error: %v", aerr)
+				return nil, aerr
+			}
+			mounts, merr := toMounts(h.Logger, cfg, cfg.Mnts, slotTemplate)
+			if merr != nil {
+				h.Logger.Errorf("Error: %v", merr)
+				return nil, merr
+			}
+			err = updateService(h.Logger, cli, ctx, &service, cfg.Scheduling.serviceMode(replicas), GetEnv(h.Logger, cfg), mounts, cfg.Scheduling.placement(cfg.Constraints), cfg.Restart.swarmPolicy(cfg.RestartPolicy), registryAuth)
+			cfg.VduService[vdu.ID] = service
 		}
-		service := cfg.VduService[vdu.ID]
-		err = updateService(h.Logger, cli, ctx, &service, vnfcCount, GetEnv(h.Logger, cfg), cfg.Mnts, cfg.Constraints, cfg.RestartPolicy)
 		if err != nil {
-			h.Logger.Errorf("Unable to update: %v", err)
-			//return nil, err
+			// the other services are still started
+			h.Logger.Errorf("%s: Unable to update the service of VDU %s: %v", cfg.Name, vdu.Name, err)
+			errs = append(errs, fmt.Sprintf("VDU %s: %v", vdu.Name, err))
+			continue
+		}
+		if _, err := h.bindTasks(cli, ctx, &cfg, vnfr, vdu); err != nil {
+			h.Logger.Warningf("%s: %v", cfg.Name, err)
 		}
 	}
 	SaveConfig(vnfr.ID, cfg, h.Logger)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("unable to start VNFR %s: %s", vnfr.Name, strings.Join(errs, "; "))
+	}
 	return vnfr, nil
 }
 
 func (h *VnfmSwarmHandler) readLogsFromContainer(cl *docker.Client, contID string, cfg VnfrConfig) {
+	// the logs are read after the operation starting the container
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	logs, _ := cl.ContainerLogs(ctx, contID, types.ContainerLogsOptions{
 		Details:    false,
 		Follow:     false,
@@ -209,19 +624,135 @@ func (h *VnfmSwarmHandler) readLogsFromContainer(cl *docker.Client, contID strin
 	}
 }
 
+// StartVNFCInstance scales the service up by one for a VNFC Instance not bound to a task, a
+// stopped service gets the replica when it is started and a global service is left as it is
 func (h *VnfmSwarmHandler) StartVNFCInstance(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		if !containsVnfc(vdu, vnfcInstance) {
+			continue
+		}
+		if _, bound := cfg.VnfcSlots[vnfcInstance.ID]; bound || cfg.VduService[vdu.ID].Spec.Mode.Global != nil {
+			return vnfr, nil
+		}
+		if replicas, stopped := cfg.Replicas[vdu.ID]; stopped {
+			if replicas < uint64(len(vdu.VNFCInstances)) {
+				cfg.Replicas[vdu.ID] = replicas + 1
+			}
+			return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
+		}
+		service := cfg.VduService[vdu.ID]
+		replicated := service.Spec.Mode.Replicated
+		if replicated == nil || replicated.Replicas == nil {
+			return nil, fmt.Errorf("service %s is not replicated and can not be scaled", service.Spec.Name)
+		}
+		cli, registryAuth, err := h.serviceClient(&cfg, vdu.ID)
+		if err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			return nil, err
+		}
+		if *replicated.Replicas < uint64(len(vdu.VNFCInstances)) {
+			if err := scaleService(cli, ctx, &service, *replicated.Replicas+1, registryAuth); err != nil {
+				h.Logger.Errorf("%s: Unable to scale service %s: %v", cfg.Name, service.Spec.Name, err)
+				return nil, err
+			}
+			cfg.VduService[vdu.ID] = service
+		}
+		if _, err := h.bindTasks(cli, ctx, &cfg, vnfr, vdu); err != nil {
+			h.Logger.Warningf("%s: %v", cfg.Name, err)
+		}
+		return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
+	}
 	return vnfr, nil
 }
 
+// Stop scales the services of the VNFR to zero keeping their spec, Start restores their replicas
 func (h *VnfmSwarmHandler) Stop(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
-	return vnfr, nil
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		service, ok := cfg.VduService[vdu.ID]
+		if !ok || h.skipGlobal(&cfg, service) {
+			continue
+		}
+		if err := h.scaleDown(ctx, &cfg, vdu.ID); err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			SaveConfig(vnfr.ID, cfg, h.Logger)
+			return nil, err
+		}
+		// a paused service is stopped and not resumed anymore
+		delete(cfg.Paused, vdu.ID)
+		// the bindings are kept for the tasks created again by Start
+		for _, vnfc := range vdu.VNFCInstances {
+			unsetVnfcTask(&cfg, vnfr, vdu.ID, vnfc)
+		}
+		h.Logger.Infof("%s: Stopped service %s with %d replicas", cfg.Name, service.Spec.Name, cfg.Replicas[vdu.ID])
+	}
+	return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
 }
 
+// StopVNFCInstance removes the task the VNFC Instance is bound to and scales its service down by
+// one, the other VNFC Instances keep their tasks unless swarm removed another one, see removeTask.
 func (h *VnfmSwarmHandler) StopVNFCInstance(vnfr *catalogue.VirtualNetworkFunctionRecord, vnfcInstance *catalogue.VNFCInstance) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	h.Logger.Noticef("Stop VNFCInstance %v with ID %v of vnfr: %v", vnfcInstance.Hostname, vnfcInstance.ID, vnfr.Name)
+	cfg := VnfrConfig{}
+	if err := getConfig(vnfr.ID, &cfg, h.Logger); err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		for i, vnfc := range vdu.VNFCInstances {
+			if vnfc.ID != vnfcInstance.ID {
+				continue
+			}
+			slot, bound := cfg.VnfcSlots[vnfc.ID]
+			replicas, stopped := cfg.Replicas[vdu.ID]
+			delete(cfg.VnfcSlots, vnfc.ID)
+			removeTaskReports(&cfg, vnfr, vnfc.Hostname)
+			vdu.VNFCInstances = append(vdu.VNFCInstances[:i], vdu.VNFCInstances[i+1:]...)
+			if stopped && bound && replicas > 0 {
+				cfg.Replicas[vdu.ID] = replicas - 1
+			} else if !stopped && bound {
+				service := cfg.VduService[vdu.ID]
+				if err := h.removeTask(ctx, &cfg, vnfr, vdu, slot); err != nil {
+					h.Logger.Errorf("%s: Unable to remove the task of VNFC Instance %s: %v", cfg.Name, vnfc.ID, err)
+					if cfg.VduService[vdu.ID].Version.Index == service.Version.Index {
+						// the service was not scaled, a retry removes the task again
+						cfg.VnfcSlots[vnfc.ID] = slot
+					}
+					SaveConfig(vnfr.ID, cfg, h.Logger)
+					return nil, err
+				}
+			}
+			return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
+		}
+	}
 	return vnfr, nil
 }
 
+// Terminate removes the services of the VNFR, after running the pre stop hook in their tasks,
+// and waits until swarm removed their tasks before removing the volumes, secrets and configs. The
+// record of the VNFR is deleted only if everything was removed.
 func (h *VnfmSwarmHandler) Terminate(vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
 	h.Logger.Noticef("Remove container for vnfr: %v", vnfr.Name)
 	cfg := &VnfrConfig{}
 	err := getConfig(vnfr.ID, cfg, h.Logger)
@@ -230,27 +761,205 @@ func (h *VnfmSwarmHandler) Terminate(vnfr *catalogue.VirtualNetworkFunctionRecor
 		h.Logger.Errorf("Probably not found")
 		return vnfr, nil
 	}
-	for _, vdu := range vnfr.VDUs {
-		cl, err := getClient(cfg.VimInstance[vdu.ID], h.CertFolder, h.Tsl)
+	errs := make([]string, 0)
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		h.Logger.Errorf("%s: %s", cfg.Name, msg)
+		errs = append(errs, msg)
+	}
+	networks := make(map[string][]string)
+	for vduID, service := range cfg.VduService {
+		vim := cfg.VimInstance[vduID]
+		cl, err := getClient(vim, h.CertFolder, h.Tsl)
 		if err != nil {
-			h.Logger.Errorf("Error while getting client: %v", err)
-			return nil, err
+			fail("unable to remove service %s: %v", service.Spec.Name, err)
+			continue
+		}
+		if len(cfg.Stop.PreStop) > 0 {
+			h.runServiceHook(cl, ctx, cfg, service, cfg.Stop.PreStop, nil)
+		}
+		tasks, err := serviceTasks(cl, ctx, service.ID)
+		if err == nil {
+			err = cl.ServiceRemove(ctx, service.ID)
+		}
+		if err == nil {
+			err = waitTasksGone(cl, ctx, tasks, cfg.Stop.grace()+30*time.Second)
+		}
+		if err != nil && !docker.IsErrNotFound(err) {
+			fail("unable to remove service %s: %v", service.Spec.Name, err)
+			continue
+		}
+		delete(cfg.VduService, vduID)
+		for _, net := range service.Spec.TaskTemplate.Networks {
+			networks[vim.ID] = append(networks[vim.ID], net.Target)
+		}
+	}
+	if len(errs) > 0 {
+		// the volumes, secrets and configs may still be used by the tasks
+		SaveConfig(vnfr.ID, *cfg, h.Logger)
+		return nil, fmt.Errorf("unable to terminate VNFR %s: %s", vnfr.Name, strings.Join(errs, "; "))
+	}
+	for _, vim := range cfg.Vims {
+		cl, err := getClient(vim, h.CertFolder, h.Tsl)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+		if cfg.VolumeRetain == VolumesDelete {
+			// the volumes are created on the nodes running the tasks, only the ones of the node
+			// the VNFM is connected to can be removed
+			if err := removeVolumes(h.Logger, cl, ctx, vnfr.ID); err != nil {
+				fail("%v", err)
+			}
+		}
+		if cfg.NetworkRetain == NetworksDelete {
+			// networks still used by the services of other VNFRs can not be removed
+			if err := removeNetworks(h.Logger, cl, ctx, networks[vim.ID]); err != nil {
+				h.Logger.Warningf("%s: %v", cfg.Name, err)
+			}
 		}
-		cl.ServiceRemove(ctx, cfg.VduService[vdu.ID].ID)
+	}
+	for secretID, vimID := range cfg.SecretIDs {
+		cl, err := getClient(cfg.Vims[vimID], h.CertFolder, h.Tsl)
+		if err == nil {
+			err = cl.SecretRemove(ctx, secretID)
+		}
+		if err != nil && !docker.IsErrNotFound(err) {
+			fail("unable to remove secret %s: %v", secretID, err)
+			continue
+		}
+		delete(cfg.SecretIDs, secretID)
+	}
+	for configID, vimID := range cfg.ConfigIDs {
+		cl, err := getClient(cfg.Vims[vimID], h.CertFolder, h.Tsl)
+		if err == nil {
+			err = cl.ConfigRemove(ctx, configID)
+		}
+		if err != nil && !docker.IsErrNotFound(err) {
+			fail("unable to remove config %s: %v", configID, err)
+			continue
+		}
+		delete(cfg.ConfigIDs, configID)
+	}
+	if len(errs) > 0 {
+		SaveConfig(vnfr.ID, *cfg, h.Logger)
+		return nil, fmt.Errorf("unable to terminate VNFR %s: %s", vnfr.Name, strings.Join(errs, "; "))
 	}
 	deleteConfig(vnfr.ID)
 
 	return vnfr, nil
 }
 
+// UpdateSoftware upgrades the image of the services of the VDUs listed in the payload of the
+// script, see imageUpdates. Swarm replaces the tasks according to the update_* parameters and
+// rolls the service back to its previous image if the new tasks fail.
 func (h *VnfmSwarmHandler) UpdateSoftware(script *catalogue.Script, vnfr *catalogue.VirtualNetworkFunctionRecord) (*catalogue.VirtualNetworkFunctionRecord, error) {
-	return vnfr, nil
+	defer lockVnfr(vnfr.ID)()
+	ctx, cancel := newOperation(h.Timeout)
+	defer cancel()
+	cfg := VnfrConfig{}
+	err := getConfig(vnfr.ID, &cfg, h.Logger)
+	if err != nil {
+		h.Logger.Errorf("Error while getting config: %v", err)
+		return nil, err
+	}
+	images, err := imageUpdates(vnfr, script)
+	if err != nil {
+		h.Logger.Errorf("%s: %v", cfg.Name, err)
+		return nil, err
+	}
+	for _, vdu := range vnfr.VDUs {
+		image, ok := images[vdu.ID]
+		if !ok {
+			continue
+		}
+		if err := h.upgradeService(ctx, vnfr, &cfg, vdu, image); err != nil {
+			h.Logger.Errorf("%s: %v", cfg.Name, err)
+			SaveConfig(vnfr.ID, cfg, h.Logger)
+			return nil, err
+		}
+	}
+	return vnfr, SaveConfig(vnfr.ID, cfg, h.Logger)
 }
 
-func (h *VnfmSwarmHandler) UpgradeSoftware() error {
+// upgradeService updates the image of the service of the VDU and waits for swarm to complete
+// the rolling update, the VNFC Instances are bound to the new tasks
+func (h *VnfmSwarmHandler) upgradeService(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig, vdu *catalogue.VirtualDeploymentUnit, image string) error {
+	vduID := vdu.ID
+	policy := cfg.Update.withDefaults()
+	service := cfg.VduService[vduID]
+	vim := cfg.VimInstance[vduID]
+	cli, err := getClient(vim, h.CertFolder, h.Tsl)
+	if err != nil {
+		return err
+	}
+	old := cfg.Vdu(vduID)
+	current := service.Spec.TaskTemplate.ContainerSpec.Image
+	image = withTag(old.ImageName, image)
+	images, err := h.Policy.allowed(vnfr.ProjectID, []string{image})
+	if err != nil {
+		return err
+	}
+	image, err = chooseServiceImage(cli, ctx, vim, images, cfg.PullPolicy, h.Credentials)
+	if err != nil {
+		return err
+	}
+	digest, err := pinImage(h.Logger, cli, ctx, vim, image, h.Credentials)
+	if err != nil {
+		return err
+	}
+	if err := h.Policy.verify(vnfr.ProjectID, digest); err != nil {
+		return err
+	}
+	if digest == current {
+		h.Logger.Infof("%s: Service %s already runs image %s", cfg.Name, service.Spec.Name, current)
+		return nil
+	}
+	registryAuth, err := h.Credentials.auth(vim, image)
+	if err != nil {
+		return err
+	}
+	h.Logger.Noticef("%s: Upgrading service %s from %s to %s", cfg.Name, service.Spec.Name, current, digest)
+	change := ImageChange{VduID: vduID, From: current, To: digest}
+	err = patchService(cli, ctx, &service, registryAuth, func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ContainerSpec.Image = digest
+		spec.UpdateConfig, spec.RollbackConfig = policy.swarmConfig()
+	})
+	if err == nil && serviceStarted(service) {
+		err = waitServiceUpdate(cli, ctx, &service, policy.Timeout)
+	}
+	cfg.VduService[vduID] = service
+	if err != nil {
+		change.Result = ImagePaused
+		if service.Spec.TaskTemplate.ContainerSpec.Image == current {
+			change.Result = ImageRolledBack
+		}
+		cfg.addImageChange(change, err)
+		return err
+	}
+	cfg.setVdu(vduID, func(vc *VduConfig) {
+		vc.ImageName = image
+		vc.ImageDigest = digest
+	})
+	for _, vnfc := range vdu.VNFCInstances {
+		reportImage(vnfr, vnfc.Hostname, digest)
+	}
+	if serviceStarted(service) {
+		if _, err := h.bindTasks(cli, ctx, cfg, vnfr, vdu); err != nil {
+			h.Logger.Warningf("%s: %v", cfg.Name, err)
+		}
+	}
+	change.Result = ImageUpgraded
+	cfg.addImageChange(change, nil)
 	return nil
 }
 
+// UpgradeSoftware does not receive the VNFR nor the new image, images are upgraded by
+// UpdateSoftware
+func (h *VnfmSwarmHandler) UpgradeSoftware() error {
+	return errors.New("upgrade the image with UpdateSoftware and a script containing the new image")
+}
+
 func (h *VnfmSwarmHandler) UserData() string {
 	return ""
 }
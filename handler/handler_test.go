@@ -8,13 +8,31 @@ import (
 	"github.com/openbaton/go-openbaton/sdk"
 	"testing"
 
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	client "docker.io/go-docker"
 	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/container"
+	"docker.io/go-docker/api/types/mount"
+	"docker.io/go-docker/api/types/network"
+	"docker.io/go-docker/api/types/swarm"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
-	//"time"
-	"encoding/json"
+	"time"
 )
 
 var log *logging.Logger = sdk.GetLogger("docker_vnfm_test", "DEBUG")
@@ -64,7 +82,7 @@ func getImagesByName(cl *client.Client, imageName string) ([]types.ImageSummary,
 	//	Key:   "repotag",
 	//	Value: imageName,
 	//})
-	imgs, err := cl.ImageList(ctx, types.ImageListOptions{})
+	imgs, err := cl.ImageList(context.Background(), types.ImageListOptions{})
 	res := make([]types.ImageSummary, 0)
 	if err != nil {
 		return nil, err
@@ -126,9 +144,10 @@ func TestCreateService(t *testing.T) {
 	imagename := "ubuntu"
 	hostname := "ubuntu"
 	netName := ""
-	netIds, err := getNetworkIdsFromNames(cli, []string{netName})
+	ctx := context.Background()
+	netIds, err := getNetworkIdsFromNames(cli, ctx, []string{netName})
 	assert.NoError(t, err)
-	res, err := createServiceWait(log, cli, ctx, 0, imagename, hostname, []string{"while true; echo 'openbaton'"}, netIds, []string{}, []string{}, make(map[string][]string), false)
+	res, err := createServiceWait(log, cli, ctx, Scheduling{}.serviceMode(0), imagename, hostname, []string{"while true; echo 'openbaton'"}, netIds, nil, Scheduling{}.placement([]string{}), SecurityProfile{}, StopPolicy{}, RestartOptions{}.swarmPolicy(""), UpdatePolicy{}, nil, nil, "", make(map[string][]string), false)
 	if !assert.NoError(t, err) {
 		assert.FailNow(t, err.Error())
 	}
@@ -137,7 +156,7 @@ func TestCreateService(t *testing.T) {
 	if !assert.NoError(t, err) {
 		assert.FailNow(t, err.Error())
 	}
-	err = updateService(log, cli, ctx, &service, 5, []string{}, []string{}, []string{}, "")
+	err = updateService(log, cli, ctx, &service, Scheduling{}.serviceMode(5), []string{}, nil, Scheduling{}.placement([]string{}), RestartOptions{}.swarmPolicy(""), "")
 	if !assert.NoError(t, err) {
 		assert.FailNow(t, err.Error())
 	}
@@ -154,3 +173,1130 @@ func getVimInstance() *catalogue.DockerVimInstance {
 		},
 	}
 }
+
+func TestParsePortSpec(t *testing.T) {
+	ports, err := ParsePortSpec("8080:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMapping{{HostPort: "8080", ContainerPort: "80", Protocol: "tcp"}}, ports)
+
+	ports, err = ParsePortSpec("127.0.0.1:5000-5001:6000-6001/udp")
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMapping{
+		{HostIP: "127.0.0.1", HostPort: "5000", ContainerPort: "6000", Protocol: "udp"},
+		{HostIP: "127.0.0.1", HostPort: "5001", ContainerPort: "6001", Protocol: "udp"},
+	}, ports)
+
+	ports, err = ParsePortSpec("[::1]::3868/sctp")
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMapping{{HostIP: "::1", ContainerPort: "3868", Protocol: "sctp"}}, ports)
+
+	ports, err = ParsePortSpec("8000-8010:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMapping{{HostPort: "8000-8010", ContainerPort: "80", Protocol: "tcp"}}, ports)
+
+	for _, spec := range []string{"", "80/icmp", "abc:80", "1.2.3:80:80", "8000-8001:80-82"} {
+		_, err = ParsePortSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestToSwarmPorts(t *testing.T) {
+	ports, err := ParsePortSpecs("8080:80;53:53/udp")
+	assert.NoError(t, err)
+	swarmPorts, err := toSwarmPorts(ports, "host")
+	assert.NoError(t, err)
+	assert.Len(t, swarmPorts, 2)
+	assert.Equal(t, uint32(53), swarmPorts[1].PublishedPort)
+	assert.Equal(t, swarm.PortConfigProtocolUDP, swarmPorts[1].Protocol)
+	assert.Equal(t, swarm.PortConfigPublishModeHost, swarmPorts[1].PublishMode)
+
+	_, err = toSwarmPorts([]PortMapping{{HostIP: "127.0.0.1", ContainerPort: "80", Protocol: "tcp"}}, "")
+	assert.Error(t, err)
+}
+
+func TestFloatingIPs(t *testing.T) {
+	vim := getVimInstance()
+	assert.Equal(t, "", externalAddress(vim, map[string]string{}))
+	assert.Equal(t, "10.0.0.1", externalAddress(vim, ParseExternalAddresses("test-vim-instance=10.0.0.1")))
+	vim.AuthURL = "tcp://192.168.0.10:2376"
+	assert.Equal(t, "192.168.0.10", externalAddress(vim, map[string]string{}))
+
+	fips := floatingIPs("192.168.0.10", []string{"mgmt"}, []*catalogue.IP{
+		{NetName: "80/tcp", IP: "0.0.0.0:8080"},
+		{NetName: "53/udp", IP: "127.0.0.1:53"},
+	})
+	assert.Equal(t, []*catalogue.IP{
+		{NetName: "mgmt", IP: "192.168.0.10"},
+		{NetName: "80/tcp", IP: "192.168.0.10:8080"},
+		{NetName: "53/udp", IP: "127.0.0.1:53"},
+	}, fips)
+}
+
+func TestFillConfigPerVdu(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		ID:   "vnfr-id",
+		Name: "app",
+		VDUs: []*catalogue.VirtualDeploymentUnit{
+			{ID: "vdu-app", Name: "app"},
+			{ID: "vdu-sidecar", Name: "sidecar"},
+		},
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "cmd", Value: "run app"},
+				{ConfKey: "publish", Value: "8080:80"},
+				{ConfKey: "sidecar.image", Value: "envoy:latest"},
+				{ConfKey: "sidecar.command", Value: "envoy -c /etc/envoy.yaml"},
+				{ConfKey: "sidecar.volumes", Value: "/etc/envoy:/etc/envoy:ro"},
+				{ConfKey: "sidecar.LOG_LEVEL", Value: "debug"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+
+	app := cfg.Vdu("vdu-app")
+	assert.Equal(t, []string{"run", "app"}, []string(app.Cmd))
+	assert.Len(t, app.Ports, 1)
+
+	sidecar := cfg.Vdu("vdu-sidecar")
+	assert.Equal(t, "envoy:latest", sidecar.ImageName)
+	assert.Equal(t, []string{"envoy", "-c", "/etc/envoy.yaml"}, []string(sidecar.Cmd))
+	assert.Equal(t, []string{"/etc/envoy:/etc/envoy:ro"}, sidecar.Mnts)
+	assert.Equal(t, "debug", sidecar.Own["LOG_LEVEL"])
+	assert.Len(t, sidecar.Ports, 1)
+	assert.NotContains(t, cfg.Own, "sidecar.LOG_LEVEL")
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	newCandidates := func() []*VimCandidate {
+		return []*VimCandidate{
+			{Vim: &catalogue.DockerVimInstance{BaseVimInstance: catalogue.BaseVimInstance{ID: "a", Name: "a"}}, MemTotal: 4 << 30, NanoCPUs: 4e9, Containers: 3},
+			{Vim: &catalogue.DockerVimInstance{BaseVimInstance: catalogue.BaseVimInstance{ID: "b", Name: "b"}}, MemTotal: 2 << 30, NanoCPUs: 2e9},
+		}
+	}
+	req := PlacementRequest{Memory: 1 << 30, Labels: map[string]string{labelVnfrName: "mongo"}}
+
+	p := &placement{l: log, strategy: spreadStrategy{}, candidates: newCandidates()}
+	vim, err := p.place(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", vim.ID)
+
+	p = &placement{l: log, strategy: binpackStrategy{}, candidates: newCandidates()}
+	for _, expected := range []string{"b", "b", "a", "a", "a", "a"} {
+		vim, err = p.place(req)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, vim.ID)
+	}
+	_, err = p.place(req)
+	assert.Error(t, err)
+
+	p = &placement{l: log, strategy: &roundRobinStrategy{}, candidates: newCandidates()}
+	req.AntiAffinity = map[string]string{labelVnfrName: "mongo"}
+	for _, expected := range []string{"a", "b"} {
+		vim, err = p.place(req)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, vim.ID)
+	}
+	_, err = p.place(req)
+	assert.Error(t, err)
+
+	// a scale out continues the round robin of the instantiation
+	req.AntiAffinity = nil
+	p = &placement{l: log, strategy: &roundRobinStrategy{}, candidates: newCandidates()}
+	vim, err = p.place(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", vim.ID)
+	next := p.position()
+	p = &placement{l: log, strategy: &roundRobinStrategy{}, candidates: newCandidates()}
+	p.resume(next)
+	vim, err = p.place(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", vim.ID)
+	assert.Equal(t, 0, (&placement{strategy: spreadStrategy{}}).position())
+
+	p = &placement{l: log, strategy: &roundRobinStrategy{}, candidates: newCandidates()}
+	p.candidates[1].Labels = []map[string]string{{labelVnfrName: "mongo"}}
+	req = PlacementRequest{Affinity: map[string]string{labelVnfrName: "mongo"}}
+	vim, err = p.place(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", vim.ID)
+}
+
+func TestFixedIPProblem(t *testing.T) {
+	netDoc := types.NetworkResource{
+		Name: "net",
+		IPAM: network.IPAM{
+			Config: []network.IPAMConfig{{Subnet: "172.20.0.0/16", Gateway: "172.20.0.1"}},
+		},
+		Containers: map[string]types.EndpointResource{
+			"abc": {Name: "mongo", IPv4Address: "172.20.0.2/16"},
+		},
+	}
+	assert.Empty(t, fixedIPProblem(netDoc, "172.20.0.3"))
+	assert.Contains(t, fixedIPProblem(netDoc, "172.20.0.2"), "already used by mongo")
+	assert.Contains(t, fixedIPProblem(netDoc, "172.20.0.1"), "gateway")
+	assert.Contains(t, fixedIPProblem(netDoc, "10.0.0.2"), "not in the ip range")
+	assert.Contains(t, fixedIPProblem(netDoc, "foo"), "not a valid ip")
+
+	report := &FeasibilityReport{Vnfr: "mongo"}
+	assert.NoError(t, report.err())
+	report.add("docker", "port", "host port %d/tcp is already bound", 80)
+	// a problem of a single vim instance only excludes it from the placement
+	assert.NoError(t, report.err())
+	report.add("docker", "vdu", "no vim instance can host VDU %s", "vdu-1")
+	report.Infeasible = append(report.Infeasible, "vdu-1")
+	assert.EqualError(t, report.err(), "Instantiation of mongo is not feasible: [docker] port: host port 80/tcp is already bound; [docker] vdu: no vim instance can host VDU vdu-1")
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	assert.Equal(t, "docker.io", registryOf("mongo:latest"))
+	assert.Equal(t, "docker.io", registryOf("library/mongo"))
+	assert.Equal(t, "registry.example.org", registryOf("registry.example.org/team/app:1.0"))
+	assert.Equal(t, "localhost:5000", registryOf("localhost:5000/app"))
+	assert.Equal(t, "docker.io", normalizeRegistry("https://index.docker.io/v1/"))
+
+	var noCreds *RegistryCredentials
+	auth, err := noCreds.auth(&catalogue.DockerVimInstance{}, "mongo")
+	assert.NoError(t, err)
+	assert.Empty(t, auth)
+
+	creds := &RegistryCredentials{
+		Registries: map[string]types.AuthConfig{"registry.example.org": {Username: "global"}},
+		Vims:       map[string]map[string]types.AuthConfig{"vim": {"registry.example.org": {Username: "vim"}}},
+	}
+	decode := func(auth string) types.AuthConfig {
+		js, err := base64.URLEncoding.DecodeString(auth)
+		assert.NoError(t, err)
+		res := types.AuthConfig{}
+		assert.NoError(t, json.Unmarshal(js, &res))
+		return res
+	}
+	vim := &catalogue.DockerVimInstance{}
+	vim.Name = "vim"
+	auth, err = creds.auth(vim, "registry.example.org/app")
+	assert.NoError(t, err)
+	assert.Equal(t, "vim", decode(auth).Username)
+	assert.Equal(t, "registry.example.org", decode(auth).ServerAddress)
+	vim.Name = "other"
+	auth, err = creds.auth(vim, "registry.example.org/app")
+	assert.NoError(t, err)
+	assert.Equal(t, "global", decode(auth).Username)
+	auth, err = creds.auth(vim, "mongo")
+	assert.NoError(t, err)
+	assert.Empty(t, auth)
+}
+
+func TestLogPullProgress(t *testing.T) {
+	log := sdk.GetLogger("test", "DEBUG")
+	body := `{"status":"Pulling from library/mongo","id":"latest"}
+{"status":"Downloading","progressDetail":{"current":1,"total":2},"progress":"[=>  ]","id":"abc"}
+{"status":"Downloading","progressDetail":{"current":2,"total":2},"progress":"[===>]","id":"abc"}
+{"status":"Pull complete","id":"abc"}
+`
+	assert.NoError(t, logPullProgress(log, "mongo", strings.NewReader(body)))
+	body += `{"errorDetail":{"message":"unauthorized"},"error":"unauthorized"}
+`
+	assert.EqualError(t, logPullProgress(log, "mongo", strings.NewReader(body)), "error pulling image mongo: unauthorized")
+}
+
+func TestPinnedImage(t *testing.T) {
+	assert.Equal(t, "mongo", repositoryOf("mongo:latest"))
+	assert.Equal(t, "localhost:5000/team/app", repositoryOf("localhost:5000/team/app:1.0"))
+	assert.Equal(t, "localhost:5000/app", repositoryOf("localhost:5000/app"))
+	assert.Equal(t, "mongo", repositoryOf("mongo@sha256:abc"))
+
+	cfg := VnfrConfig{ImageName: "mongo:latest", Vdus: map[string]VduConfig{}}
+	assert.Equal(t, "mongo:latest", cfg.Vdu("vdu").image())
+	cfg.ImageDigest = "mongo@sha256:abc"
+	assert.Equal(t, "mongo@sha256:abc", cfg.Vdu("vdu").image())
+
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{}
+	reportImage(vnfr, "mongo-1234", "mongo@sha256:abc")
+	reportImage(vnfr, "mongo-1234", "mongo@sha256:def")
+	reportImage(vnfr, "mongo-5678", "mongo@sha256:def")
+	assert.Len(t, vnfr.Configurations.ConfigurationParameters, 2)
+	assert.Equal(t, "mongo-1234.image_digest", vnfr.Configurations.ConfigurationParameters[0].ConfKey)
+	assert.Equal(t, "mongo@sha256:def", vnfr.Configurations.ConfigurationParameters[0].Value)
+	removeImageReport(vnfr, "mongo-1234")
+	assert.Len(t, vnfr.Configurations.ConfigurationParameters, 1)
+	assert.Equal(t, "mongo-5678.image_digest", vnfr.Configurations.ConfigurationParameters[0].ConfKey)
+}
+
+func TestImagePolicy(t *testing.T) {
+	assert.Equal(t, "docker.io/library/mongo", fullRepository("mongo:latest"))
+	assert.Equal(t, "docker.io/user/app", fullRepository("user/app"))
+	assert.Equal(t, "registry.example.org/team/app", fullRepository("registry.example.org/team/app:1.0"))
+
+	dir, err := ioutil.TempDir("", "policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(dir, "team.pem")
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	digest := "sha256:0123456789abcdef"
+	hash := sha256.Sum256([]byte(digest))
+	r, ss, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	assert.NoError(t, err)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sha256-0123456789abcdef.sig"), []byte(base64.StdEncoding.EncodeToString(sig)), 0600))
+	policyFile := filepath.Join(dir, "policy.json")
+	assert.NoError(t, ioutil.WriteFile(policyFile, []byte(fmt.Sprintf(`{
+		"keys": {"team": %q},
+		"signatures_dir": %q,
+		"default": {"repositories": ["docker.io/library/*"]},
+		"projects": {"team": {"registries": ["registry.example.org"], "signed_by": ["team"]}}
+	}`, keyFile, dir)), 0600))
+
+	policy, err := LoadImagePolicy(policyFile)
+	assert.NoError(t, err)
+	images, err := policy.allowed("other", []string{"user/app", "mongo:latest"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mongo:latest"}, images)
+	_, err = policy.allowed("other", []string{"user/app"})
+	assert.IsType(t, &PolicyViolation{}, err)
+	assert.NoError(t, policy.verify("other", "mongo:latest"))
+
+	_, err = policy.allowed("team", []string{"mongo:latest"})
+	assert.Error(t, err)
+	assert.NoError(t, policy.verify("team", "registry.example.org/app@"+digest))
+	assert.Error(t, policy.verify("team", "registry.example.org/app@sha256:fedcba"))
+	assert.Error(t, policy.verify("team", "registry.example.org/app:1.0"))
+
+	var noPolicy *ImagePolicy
+	images, err = noPolicy.allowed("team", []string{"user/app"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user/app"}, images)
+	assert.NoError(t, noPolicy.verify("team", "user/app"))
+}
+
+func TestSecurityProfile(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		ID:   "vnfr-id",
+		Name: "app",
+		VDUs: []*catalogue.VirtualDeploymentUnit{{ID: "vdu-app", Name: "app"}},
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "cap_add", Value: "NET_ADMIN"},
+				{ConfKey: "read_only", Value: "false"},
+				{ConfKey: "apparmor_profile", Value: "docker-default"},
+				{ConfKey: "run_as_user", Value: "1000:1000"},
+				{ConfKey: "USER", Value: "mongo"},
+			},
+		},
+	}
+	defaults := SecurityProfile{CapDrop: []string{"ALL"}, ReadOnly: true, NoNewPrivileges: true}
+	cfg := NewVnfrConfig(vnfr)
+	cfg.Security = defaults.clone()
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo", cfg.Own["USER"])
+	assert.Equal(t, []string{"ALL"}, cfg.Security.CapDrop)
+	assert.Equal(t, []string{"NET_ADMIN"}, cfg.Security.CapAdd)
+	assert.True(t, defaults.ReadOnly)
+
+	config := &container.Config{}
+	hostCfg := &container.HostConfig{}
+	assert.NoError(t, cfg.Security.applyToContainer(config, hostCfg))
+	assert.Equal(t, "1000:1000", config.User)
+	assert.False(t, hostCfg.ReadonlyRootfs)
+	assert.Equal(t, []string{"NET_ADMIN"}, []string(hostCfg.CapAdd))
+	assert.Equal(t, []string{"no-new-privileges", "apparmor=docker-default"}, hostCfg.SecurityOpt)
+
+	spec := &swarm.ContainerSpec{}
+	assert.Equal(t, []string{"cap_add", "cap_drop", "no_new_privileges", "apparmor_profile"}, cfg.Security.applyToService(spec))
+	assert.Equal(t, "1000:1000", spec.User)
+
+	vnfr.Configurations.ConfigurationParameters = []*catalogue.ConfigurationParameter{{ConfKey: "privileged", Value: "maybe"}}
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+	vnfr.Configurations.ConfigurationParameters = []*catalogue.ConfigurationParameter{{ConfKey: "seccomp_profile", Value: "/does/not/exist.json"}}
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+}
+
+func TestSecrets(t *testing.T) {
+	key := make([]byte, 32)
+	encrypted, err := EncryptSecrets([]byte(`{"mongo/password": "s3cret"}`), key)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secrets.enc")
+	assert.NoError(t, ioutil.WriteFile(file, encrypted, 0600))
+	src, err := LoadFileSecretSource(file, key)
+	assert.NoError(t, err)
+	val, err := src.Secret("mongo/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", string(val))
+	_, err = LoadFileSecretSource(file, make([]byte, 16))
+	assert.Error(t, err)
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/mongo" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"password": "fromvault"}}}`))
+	}))
+	defer vault.Close()
+	vaultSrc := &VaultSecretSource{Address: vault.URL, Token: "token", Client: vault.Client()}
+	val, err = vaultSrc.Secret("secret/data/mongo#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "fromvault", string(val))
+	_, err = vaultSrc.Secret("secret/data/other")
+	assert.Error(t, err)
+
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "mongo",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "secrets", Value: "DB_PASSWORD"},
+				{ConfKey: "DB_PASSWORD", Value: "mongo/password"},
+				{ConfKey: "DB_USER", Value: "admin"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DB_PASSWORD"}, cfg.Secrets)
+	assert.NotContains(t, cfg.Own, "DB_PASSWORD")
+	assert.Contains(t, GetEnv(log, cfg), "DB_PASSWORD_FILE=/run/secrets/DB_PASSWORD")
+
+	secrets, err := resolveSecrets(src, vnfr, cfg.Secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", string(secrets["DB_PASSWORD"]))
+	secrets, err = resolveSecrets(nil, vnfr, cfg.Secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo/password", string(secrets["DB_PASSWORD"]))
+	_, err = resolveSecrets(src, vnfr, []string{"MISSING"})
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"sh", "-c", `rm -f "$1" && umask 0277 && cat > "$1"`, "sh", "/run/secrets/DB_PASSWORD", ""}, secretCommand("DB_PASSWORD", ""))
+	assert.Equal(t, `rm -f "$1" && umask 0277 && cat > "$1" && chown "$2" "$1"`, secretCommand("DB_PASSWORD", "mongodb")[2])
+	assert.Equal(t, "mongodb", secretCommand("DB_PASSWORD", "mongodb")[5])
+
+	cfg = VnfrConfig{}
+	assert.NoError(t, checkSecrets(cfg, secrets))
+	cfg.RestartPolicy = "any"
+	assert.Error(t, checkSecrets(cfg, secrets))
+	assert.NoError(t, checkSecrets(cfg, nil))
+	cfg = VnfrConfig{Security: SecurityProfile{User: "mongodb", CapDrop: []string{"ALL"}}}
+	assert.Error(t, checkSecrets(cfg, secrets))
+	cfg.Security.CapAdd = []string{"CAP_CHOWN"}
+	assert.NoError(t, checkSecrets(cfg, secrets))
+	cfg.Security.User = ""
+	cfg.Security.CapAdd = nil
+	assert.NoError(t, checkSecrets(cfg, secrets))
+}
+
+func TestConfigFiles(t *testing.T) {
+	_, err := ParseConfigFiles("mongod.conf.tmpl:etc/mongod.conf")
+	assert.Error(t, err)
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "app",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "config_files", Value: "app.yaml:/etc/app/app.yaml;INLINE:/etc/app/inline.conf"},
+				{ConfKey: "config_reload", Value: "SIGHUP"},
+				{ConfKey: "INLINE", Value: "name={{ .Name }}"},
+				{ConfKey: "PORT", Value: "8080"},
+			},
+		},
+	}
+	scripts := []*catalogue.Script{{Name: "app.yaml", Payload: []byte(`port: {{ .Own.PORT }}
+mongo: {{ range .Foreign.mongo }}{{ .private }} {{ end }}`)}}
+	cfg := NewVnfrConfig(vnfr)
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGHUP", cfg.ConfigReload)
+	assert.NoError(t, cfg.loadTemplates(vnfr, scripts))
+	assert.NotContains(t, cfg.Own, "INLINE")
+
+	files, changed, err := cfg.renderConfigFiles()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "port: 8080\nmongo: ", string(files["/etc/app/app.yaml"]))
+	assert.Equal(t, "name=app", string(files["/etc/app/inline.conf"]))
+	assert.Equal(t, []string{"/etc/app"}, configDirs(files))
+
+	_, changed, err = cfg.renderConfigFiles()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	cfg.Foreign = map[string][]map[string]string{"mongo": {{"private": "10.0.0.2"}, {"private": "10.0.0.3"}}}
+	files, changed, err = cfg.renderConfigFiles()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "port: 8080\nmongo: 10.0.0.2 10.0.0.3 ", string(files["/etc/app/app.yaml"]))
+
+	cfg.ConfigFiles = append(cfg.ConfigFiles, ConfigFile{Source: "missing", Path: "/etc/missing"})
+	assert.Error(t, cfg.loadTemplates(vnfr, scripts))
+}
+
+func TestDependencyChange(t *testing.T) {
+	assert.False(t, envChanged([]string{"A=1", "B=2"}, []string{"B=2", "A=1"}))
+	assert.True(t, envChanged([]string{"A=1", "B=2"}, []string{"A=1", "B=3"}))
+	assert.True(t, envChanged([]string{"A=1"}, []string{"A=1", "MONGO_PRIVATE=10.0.0.2"}))
+
+	dep := &catalogue.VNFCDependencyParameters{Parameters: map[string]*catalogue.DependencyParameters{
+		"vnfc-2": {Parameters: map[string]string{"private": "10.0.0.3"}},
+		"vnfc-1": {Parameters: map[string]string{"private": "10.0.0.2"}},
+		"vnfc-3": {Parameters: map[string]string{"private": "10.0.0.4"}},
+	}}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, []map[string]string{{"private": "10.0.0.2"}, {"private": "10.0.0.3"}, {"private": "10.0.0.4"}}, foreignParameters(log, dep))
+	}
+
+	assert.True(t, validDependencyReaction("recreate"))
+	assert.True(t, validDependencyReaction("exec:/usr/local/bin/reload.sh now"))
+	assert.False(t, validDependencyReaction("exec:"))
+	assert.False(t, validDependencyReaction("restart"))
+	assert.Equal(t, []string{"/usr/local/bin/reload.sh", "now"}, reloadHook("exec:/usr/local/bin/reload.sh now"))
+	assert.Nil(t, reloadHook(ReactionUpdate))
+
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "app",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "on_dependency_change", Value: "update"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, ReactionUpdate, cfg.OnDependency)
+	vnfr.Configurations.ConfigurationParameters[0].Value = "reboot"
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+
+	var zero uint64
+	assert.False(t, serviceStarted(swarm.Service{Spec: swarm.ServiceSpec{Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &zero}}}}))
+	assert.True(t, serviceStarted(swarm.Service{Spec: swarm.ServiceSpec{Mode: swarm.ServiceMode{Global: &swarm.GlobalService{}}}}))
+}
+
+func TestGetEnv(t *testing.T) {
+	cfg := VnfrConfig{
+		Name: "client",
+		Own:  map[string]string{"PORT": "8080", "MODE": "replica"},
+		Foreign: map[string][]map[string]string{
+			"server": {
+				{"hostname": "server-1", "private": "10.0.0.2"},
+				{"hostname": "server-2"},
+			},
+			"db": {{"private": "10.0.1.2"}},
+		},
+	}
+	assert.Equal(t, []string{
+		"MODE=replica",
+		"PORT=8080",
+		"DB_PRIVATE=10.0.1.2",
+		"SERVER_HOSTNAME=server-1",
+		"SERVER_PRIVATE=10.0.0.2",
+		"SERVER_HOSTNAME=server-2",
+	}, GetEnv(log, cfg))
+
+	cfg.EnvFormat = EnvIndexed
+	expected := []string{
+		"MODE=replica",
+		"PORT=8080",
+		"DB_COUNT=1",
+		"DB_PRIVATE_0=10.0.1.2",
+		"DB_PRIVATE_ALL=10.0.1.2",
+		"SERVER_COUNT=2",
+		"SERVER_HOSTNAME_0=server-1",
+		"SERVER_HOSTNAME_1=server-2",
+		"SERVER_HOSTNAME_ALL=server-1,server-2",
+		"SERVER_PRIVATE_0=10.0.0.2",
+		"SERVER_PRIVATE_ALL=10.0.0.2",
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, GetEnv(log, cfg))
+	}
+}
+
+func TestMounts(t *testing.T) {
+	m, err := ParseMount("/srv/data:/data:ro")
+	assert.NoError(t, err)
+	assert.Equal(t, MountSpec{Type: mount.TypeBind, Source: "/srv/data", Target: "/data", ReadOnly: true}, m)
+	m, err = ParseMount("tmpfs:/run/cache:size=64m,mode=1777")
+	assert.NoError(t, err)
+	assert.Equal(t, MountSpec{Type: mount.TypeTmpfs, Target: "/run/cache", TmpfsSize: 64 * 1024 * 1024, TmpfsMode: 01777}, m)
+	_, err = ParseMount("tmpfs:/run/cache:per-vnfc")
+	assert.Error(t, err)
+	_, err = ParseMount("data")
+	assert.Error(t, err)
+	_, err = ParseMount("-data:/data")
+	assert.Error(t, err)
+
+	m, err = ParseMount("db:/data/db:per-vnfc,nocopy")
+	assert.NoError(t, err)
+	driver := VolumeDriver{Name: "local", Options: map[string]string{"type": "nfs"}}
+	mnt := m.toMount("vnfr", slotTemplate, driver)
+	assert.Equal(t, mount.TypeVolume, mnt.Type)
+	assert.Equal(t, "vnfr_db_{{.Task.Slot}}", mnt.Source)
+	assert.True(t, mnt.VolumeOptions.NoCopy)
+	assert.Equal(t, "vnfr", mnt.VolumeOptions.Labels[labelVnfrID])
+	assert.Equal(t, "local", mnt.VolumeOptions.DriverConfig.Name)
+	m, _ = ParseMount("shared:/shared")
+	mnt = m.toMount("vnfr", "vnfc", VolumeDriver{})
+	assert.Equal(t, "vnfr_shared", mnt.Source)
+	assert.Nil(t, mnt.VolumeOptions.DriverConfig)
+
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "mongo",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "volumes", Value: "db:/data/db:per-vnfc;tmpfs:/tmp"},
+				{ConfKey: "volume_driver_opts", Value: "type=nfs;o=addr=10.0.0.1,rw"},
+				{ConfKey: "volume_retention", Value: "delete"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, VolumesDelete, cfg.VolumeRetain)
+	assert.Equal(t, "addr=10.0.0.1,rw", cfg.VolumeDriver.Options["o"])
+	mounts, err := toMounts(log, cfg, cfg.Mnts, "vnfc")
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 2)
+	assert.Equal(t, cfg.VnfrID+"_db_vnfc", mounts[0].Source)
+	vnfr.Configurations.ConfigurationParameters[0].Value = "db:data"
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+}
+
+func TestBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backups := &Backups{Dir: dir, Logger: log}
+	for i, id := range []string{"vnfr-1-20180101T000000Z", "vnfr-1-20180102T000000Z", "vnfr-2-20180101T000000Z"} {
+		manifest := BackupManifest{
+			ID:      id,
+			VnfrID:  id[:6],
+			Created: time.Date(2018, 1, 1+i, 0, 0, 0, 0, time.UTC),
+			Volumes: []BackupVolume{
+				{File: "0.tar", VduID: "vdu-1", Type: mount.TypeVolume, Scope: "vnfc-1", Destination: "/data/db"},
+				{File: "1.tar", VduID: "vdu-1", Type: mount.TypeVolume, Scope: "vnfc-2", Destination: "/data/db"},
+				{File: "2.tar", VduID: "vdu-2", Type: mount.TypeBind, Destination: "/data/db"},
+			},
+		}
+		js, _ := json.Marshal(manifest)
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, id), 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, id, manifestFile), js, 0600))
+	}
+	list, err := backups.List("vnfr-1")
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "vnfr-1-20180102T000000Z", list[0].ID)
+	_, err = backups.Get("../etc")
+	assert.Error(t, err)
+
+	manifest, err := backups.Get("vnfr-1-20180101T000000Z")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.tar", manifest.volumeFor("vdu-1", "vnfc-2", "/data/db").File)
+	assert.Equal(t, "2.tar", manifest.volumeFor("vdu-2", "vnfc-3", "/data/db").File)
+	assert.Equal(t, "0.tar", manifest.volumeFor("other-vdu", "", "/data/db").File)
+	assert.Nil(t, manifest.volumeFor("vdu-1", "vnfc-1", "/data/other"))
+	cfg := VnfrConfig{ConfigFiles: []ConfigFile{{Path: "/etc/app/app.yaml"}, {Path: "/etc/app/inline.conf"}}}
+	assert.Equal(t, []string{"/run/secrets", "/etc/app"}, cfg.generatedDirs())
+
+	srv := httptest.NewServer(backups)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/backups?vnfr=vnfr-2")
+	assert.NoError(t, err)
+	list = make([]*BackupManifest, 0)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	assert.Len(t, list, 1)
+	resp, err = http.Get(srv.URL + "/backups/missing")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(srv.URL + "/vnfrs")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestImageUpdates(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "app",
+		VDUs: []*catalogue.VirtualDeploymentUnit{
+			{ID: "vdu-1", Name: "web"},
+			{ID: "vdu-2", Name: "db"},
+		},
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "update_parallelism", Value: "2"},
+				{ConfKey: "update_delay", Value: "10s"},
+			},
+		},
+	}
+	images, err := imageUpdates(vnfr, &catalogue.Script{Name: "upgrade", Payload: []byte("nginx:1.15\n# database\ndb=:3.6\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"vdu-1": "nginx:1.15", "vdu-2": ":3.6"}, images)
+	_, err = imageUpdates(vnfr, &catalogue.Script{Name: "upgrade", Payload: []byte("cache=redis")})
+	assert.Error(t, err)
+	_, err = imageUpdates(vnfr, &catalogue.Script{Name: "upgrade"})
+	assert.Error(t, err)
+	assert.Equal(t, "registry:5000/mongo:3.6", withTag("registry:5000/mongo:3.4", ":3.6"))
+	assert.Equal(t, "mongo:3.6", withTag("mongo@sha256:abc", ":3.6"))
+	assert.Equal(t, "redis", withTag("mongo", "redis"))
+
+	cfg := NewVnfrConfig(vnfr)
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	policy := cfg.Update.withDefaults()
+	assert.Equal(t, uint64(2), policy.Parallelism)
+	assert.Equal(t, 10*time.Second, policy.Delay)
+	assert.Equal(t, UpdateRollback, policy.FailureAction)
+	update, rollback := policy.swarmConfig()
+	assert.Equal(t, UpdateRollback, update.FailureAction)
+	assert.Equal(t, UpdatePause, rollback.FailureAction)
+	vnfr.Configurations.ConfigurationParameters[0] = &catalogue.ConfigurationParameter{ConfKey: "update_failure_action", Value: "retry"}
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+
+	cfg.setVdu("vdu-1", func(vc *VduConfig) {
+		vc.NetworkCfg = map[string]NetConf{"mgmt_abc": {}, "data_abc": {}}
+	})
+	cfg.VnfcNetworks["vnfc-1"] = map[string]NetConf{"mgmt_abc": {}, "data_abc": {IpV4Address: "10.0.1.5"}}
+	cfg.VnfcNetworks["vnfc-2"] = map[string]NetConf{"mgmt_abc": {}, "data_abc": {IpV4Address: "10.0.1.6"}}
+	pinned := cfg.withIPs("vdu-1", "vnfc-1", map[string]string{"mgmt_abc": "10.0.0.7", "data_abc": "10.0.1.9"})
+	assert.Equal(t, "10.0.0.7", pinned.networkCfg("vdu-1", "vnfc-1")["mgmt_abc"].IpV4Address)
+	assert.Equal(t, "10.0.1.5", pinned.networkCfg("vdu-1", "vnfc-1")["data_abc"].IpV4Address)
+	assert.Equal(t, "10.0.1.6", pinned.networkCfg("vdu-1", "vnfc-2")["data_abc"].IpV4Address)
+	assert.Equal(t, "", cfg.networkCfg("vdu-1", "vnfc-1")["mgmt_abc"].IpV4Address)
+	// VNFC Instances without fixed ips get the networks of the VDU
+	assert.Equal(t, map[string]NetConf{"mgmt_abc": {}, "data_abc": {}}, cfg.networkCfg("vdu-1", "vnfc-3"))
+	pinned = cfg.withIPs("vdu-1", "vnfc-3", map[string]string{"mgmt_abc": "10.0.0.8"})
+	assert.Equal(t, "10.0.0.8", pinned.networkCfg("vdu-1", "vnfc-3")["mgmt_abc"].IpV4Address)
+	assert.Equal(t, "", pinned.Vdu("vdu-1").NetworkCfg["mgmt_abc"].IpV4Address)
+}
+
+type fakeSuspender struct {
+	paused map[string]string
+}
+
+func (s *fakeSuspender) Pause(vnfrID, vcID string) error {
+	if vnfrID == "missing" {
+		return errors.New("not found")
+	}
+	s.paused[vnfrID] = vcID
+	return nil
+}
+
+func (s *fakeSuspender) Unpause(vnfrID, vcID string) error {
+	delete(s.paused, vnfrID)
+	return nil
+}
+
+func TestVnfrLock(t *testing.T) {
+	unlock := lockVnfr("vnfr-1")
+	locked := make(chan bool)
+	go func() {
+		defer lockVnfr("vnfr-1")()
+		locked <- true
+	}()
+	// another VNFR is not blocked
+	lockVnfr("vnfr-2")()
+	select {
+	case <-locked:
+		t.Fatal("the VNFR was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	assert.True(t, <-locked)
+}
+
+func TestPauseApi(t *testing.T) {
+	suspender := &fakeSuspender{paused: make(map[string]string)}
+	srv := httptest.NewServer(&Api{Logger: log, Suspender: suspender})
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/vnfrs/vnfr-1/pause?vnfc=abc", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "abc", suspender.paused["vnfr-1"])
+	resp, err = http.Post(srv.URL+"/vnfrs/missing/pause", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Post(srv.URL+"/vnfrs/vnfr-1/resume", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, suspender.paused)
+	// the backups are not enabled
+	resp, err = http.Get(srv.URL + "/backups")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	tokenSrv := httptest.NewServer(&Api{Logger: log, Suspender: suspender, Token: "t0ken"})
+	defer tokenSrv.Close()
+	resp, err = http.Post(tokenSrv.URL+"/vnfrs/vnfr-1/pause", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, suspender.paused)
+	req, _ := http.NewRequest(http.MethodPost, tokenSrv.URL+"/vnfrs/vnfr-1/pause", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	for addr, expected := range map[string]string{
+		":8090":          "127.0.0.1:8090",
+		"localhost:8090": "localhost:8090",
+		"[::1]:8090":     "[::1]:8090",
+		"0.0.0.0:8090":   "",
+		"10.0.0.2:8090":  "",
+	} {
+		listen, loopback := ApiAddress(addr)
+		assert.Equal(t, expected != "", loopback, addr)
+		if loopback {
+			assert.Equal(t, expected, listen)
+		}
+	}
+
+	vnfc := &catalogue.VNFCInstance{ID: "vnfc-1"}
+	vdu := &catalogue.VirtualDeploymentUnit{VNFCInstances: []*catalogue.VNFCInstance{vnfc}}
+	assert.True(t, containsVnfc(vdu, &catalogue.VNFCInstance{ID: "vnfc-1"}))
+	assert.False(t, containsVnfc(vdu, &catalogue.VNFCInstance{ID: "vnfc-2"}))
+}
+
+func TestParseMigration(t *testing.T) {
+	vim, volumes, ok := parseMigration("migrate:docker-2:volumes")
+	assert.True(t, ok)
+	assert.True(t, volumes)
+	assert.Equal(t, "docker-2", vim)
+	vim, volumes, ok = parseMigration("migrate:docker-2")
+	assert.True(t, ok)
+	assert.False(t, volumes)
+	_, _, ok = parseMigration("migrate:")
+	assert.False(t, ok)
+	_, _, ok = parseMigration("host down")
+	assert.False(t, ok)
+}
+
+func TestStopPolicy(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "mongo",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "stop_signal", Value: "SIGINT"},
+				{ConfKey: "stop_grace_period", Value: "1m"},
+				{ConfKey: "pre_stop", Value: "mongo --eval db.fsyncLock()"},
+				{ConfKey: "network_retention", Value: "delete"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, "SIGINT", cfg.Stop.Signal)
+	assert.Equal(t, time.Minute, cfg.Stop.grace())
+	assert.Equal(t, []string{"mongo", "--eval", "db.fsyncLock()"}, cfg.Stop.PreStop)
+	assert.Equal(t, NetworksDelete, cfg.NetworkRetain)
+	assert.Empty(t, cfg.Own)
+	assert.Equal(t, defaultGracePeriod, StopPolicy{}.grace())
+	// docker counts the grace period in seconds
+	assert.Equal(t, time.Second, StopPolicy{GracePeriod: 500 * time.Millisecond}.grace())
+	assert.Equal(t, 2*time.Second, StopPolicy{GracePeriod: 1500 * time.Millisecond}.grace())
+
+	vnfr.Configurations.ConfigurationParameters[1].Value = "60"
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+	vnfr.Configurations.ConfigurationParameters[1].Value = "1m"
+	vnfr.Configurations.ConfigurationParameters[3].Value = "remove"
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+}
+
+func TestNetworkRetention(t *testing.T) {
+	// a docker daemon with the containers c1 and c2 of the VNFR and the container of another one
+	networks := map[string]*types.NetworkResource{
+		"app-net": {Name: "app-net", ID: "n1", Containers: map[string]types.EndpointResource{"c1": {}, "c2": {}}},
+		"shared":  {Name: "shared", ID: "n2", Containers: map[string]types.EndpointResource{"c1": {}, "other": {}}},
+		"bridge":  {Name: "bridge", ID: "n3", Containers: map[string]types.EndpointResource{"c1": {}}},
+	}
+	removed := make([]string, 0)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:]
+		switch {
+		case p == "/containers/c1/json":
+			json.NewEncoder(w).Encode(types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{ID: "c1"},
+				NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+					"app-net": {}, "shared": {}, "bridge": {},
+				}},
+			})
+		case strings.HasPrefix(p, "/networks/") && r.Method == http.MethodGet:
+			for _, net := range networks {
+				if net.Name == strings.TrimPrefix(p, "/networks/") {
+					json.NewEncoder(w).Encode(net)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(p, "/networks/") && r.Method == http.MethodDelete:
+			removed = append(removed, strings.TrimPrefix(p, "/networks/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer daemon.Close()
+	cli, err := client.NewClient("tcp://"+daemon.Listener.Addr().String(), "1.35", daemon.Client(), nil)
+	assert.NoError(t, err)
+
+	owned := ownedNetworks(cli, context.Background(), "c1", []string{"c1", "c2"})
+	assert.Equal(t, []string{"app-net", "bridge"}, owned)
+	// the containers of the VNFR are removed
+	for _, net := range networks {
+		delete(net.Containers, "c1")
+		delete(net.Containers, "c2")
+	}
+	assert.NoError(t, removeNetworks(log, cli, context.Background(), owned))
+	assert.Equal(t, []string{"n1"}, removed)
+}
+
+func TestBindSlots(t *testing.T) {
+	bindings := make(map[string]int)
+	bindSlots(bindings, []string{"a", "b", "c"}, []int{3, 1, 2})
+	assert.Equal(t, map[string]int{"a": 1, "b": 2, "c": 3}, bindings)
+
+	// c stopped, swarm removed the task of b instead of the one of c
+	delete(bindings, "c")
+	bindSlots(bindings, []string{"a", "b"}, []int{1, 3})
+	assert.Equal(t, map[string]int{"a": 1, "b": 3}, bindings)
+
+	// scaled up again, the tasks get new slots
+	bindSlots(bindings, []string{"a", "b", "d"}, []int{1, 2, 3})
+	assert.Equal(t, map[string]int{"a": 1, "b": 3, "d": 2}, bindings)
+
+	// not enough tasks
+	bindSlots(bindings, []string{"a", "b", "d"}, []int{2})
+	assert.Equal(t, map[string]int{"d": 2}, bindings)
+}
+
+func TestNodeURL(t *testing.T) {
+	u, err := nodeURL("tcp://manager.example.org:2376", "10.0.0.12")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://10.0.0.12:2376", u)
+	_, err = nodeURL("unix:///var/run/docker.sock", "10.0.0.12")
+	assert.Error(t, err)
+	_, err = nodeURL("tcp://manager.example.org:2376", "")
+	assert.Error(t, err)
+}
+
+func TestTaskIPs(t *testing.T) {
+	task := swarm.Task{
+		Slot: 2,
+		NetworksAttachments: []swarm.NetworkAttachment{
+			{Network: swarm.Network{Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "ingress"}}}, Addresses: []string{"10.255.0.7/16"}},
+			{Network: swarm.Network{Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "private"}}}, Addresses: []string{"10.0.1.5/24"}},
+		},
+	}
+	assert.Equal(t, []*catalogue.IP{{NetName: "private", IP: "10.0.1.5"}}, taskIPs(task))
+
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{Name: "mongo"}
+	cfg := NewVnfrConfig(vnfr)
+	cfg.BaseHostname = "mongo"
+	cfg.VduService["vdu"] = swarm.Service{Spec: swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "mongo@sha256:1"}}}}
+	cfg.setServiceIPs(vnfr, "vdu", "mongo", []*catalogue.IP{{NetName: "public", IP: "10.0.2.2"}, {NetName: "private", IP: "10.0.1.2"}})
+	assert.Equal(t, []*catalogue.IP{{NetName: "private", IP: "10.0.1.2"}, {NetName: "public", IP: "10.0.2.2"}}, cfg.serviceIPs("vdu"))
+	assert.Len(t, vnfr.Configurations.ConfigurationParameters, 2)
+	assert.Equal(t, "mongo.private.service_ip", vnfr.Configurations.ConfigurationParameters[1].ConfKey)
+
+	vnfc := &catalogue.VNFCInstance{ID: "a", Hostname: "mongo.2", VCID: "abc"}
+	reportImage(vnfr, vnfc.Hostname, "mongo@sha256:1")
+	reportParameter(vnfr, "mongo.2.slot", "2", "")
+	unsetVnfcTask(&cfg, vnfr, "vdu", vnfc)
+	assert.Equal(t, "mongo", vnfc.Hostname)
+	assert.Empty(t, vnfc.VCID)
+	assert.Equal(t, cfg.serviceIPs("vdu"), vnfc.IPs)
+	for _, cp := range vnfr.Configurations.ConfigurationParameters {
+		assert.False(t, strings.HasPrefix(cp.ConfKey, "mongo.2."), cp.ConfKey)
+	}
+}
+
+func TestScheduling(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "probe",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "placement_preferences", Value: "spread=node.labels.zone;spread=engine.labels.rack"},
+				{ConfKey: "platforms", Value: "linux/amd64;linux/arm64"},
+				{ConfKey: "constraints", Value: "node.role==worker;node.labels.zone != eu"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node.labels.zone", "engine.labels.rack"}, cfg.Scheduling.Preferences)
+	assert.Equal(t, []swarm.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}, cfg.Scheduling.Platforms)
+	assert.Empty(t, cfg.Own)
+	p := cfg.Scheduling.placement(cfg.Constraints)
+	assert.Equal(t, "engine.labels.rack", p.Preferences[1].Spread.SpreadDescriptor)
+	assert.Equal(t, uint64(3), *cfg.Scheduling.serviceMode(3).Replicated.Replicas)
+
+	for _, value := range []string{"node.role=worker", "node.role==boss", "node.labels.==eu", "node.zone==eu", "node.id=="} {
+		vnfr.Configurations.ConfigurationParameters[2].Value = value
+		_, err = FillConfig(vnfr, &cfg, log)
+		assert.Error(t, err, value)
+	}
+	vnfr.Configurations.ConfigurationParameters[2].Value = "node.role==worker"
+	vnfr.Configurations.ConfigurationParameters = append(vnfr.Configurations.ConfigurationParameters, &catalogue.ConfigurationParameter{ConfKey: "mode", Value: "global"})
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+	cfg = NewVnfrConfig(vnfr)
+	vnfr.Configurations.ConfigurationParameters = vnfr.Configurations.ConfigurationParameters[2:]
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg.Scheduling.serviceMode(3).Global)
+	vnfr.Configurations.ConfigurationParameters[1].Value = "daemon"
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+	// swarm would not enforce the limit with the api of the VNFM
+	vnfr.Configurations.ConfigurationParameters[1] = &catalogue.ConfigurationParameter{ConfKey: "max_replicas_per_node", Value: "2"}
+	_, err = FillConfig(vnfr, &cfg, log)
+	assert.Error(t, err)
+}
+
+func TestServicePolicies(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "web",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "restart_policy_condition", Value: "on-failure"},
+				{ConfKey: "restart_delay", Value: "3s"},
+				{ConfKey: "restart_max_attempts", Value: "5"},
+				{ConfKey: "restart_window", Value: "1m"},
+				{ConfKey: "update_order", Value: "start-first"},
+				{ConfKey: "update_parallelism", Value: "2"},
+				{ConfKey: "rollback_monitor", Value: "20s"},
+				{ConfKey: "rollback_failure_action", Value: "continue"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Own)
+	restart := cfg.Restart.swarmPolicy(cfg.RestartPolicy)
+	assert.Equal(t, swarm.RestartPolicyConditionOnFailure, restart.Condition)
+	assert.Equal(t, 3*time.Second, *restart.Delay)
+	assert.Equal(t, uint64(5), *restart.MaxAttempts)
+	assert.Equal(t, time.Minute, *restart.Window)
+	defaults := RestartOptions{}.swarmPolicy("")
+	assert.Equal(t, swarm.RestartPolicyConditionNone, defaults.Condition)
+	assert.Nil(t, defaults.Delay)
+	assert.Nil(t, defaults.MaxAttempts)
+
+	update, rollback := cfg.Update.swarmConfig()
+	assert.Equal(t, swarm.UpdateOrderStartFirst, update.Order)
+	assert.Equal(t, uint64(2), update.Parallelism)
+	assert.Equal(t, 5*time.Second, update.Monitor)
+	assert.Equal(t, swarm.UpdateOrderStartFirst, rollback.Order)
+	assert.Equal(t, uint64(2), rollback.Parallelism)
+	assert.Equal(t, 20*time.Second, rollback.Monitor)
+	assert.Equal(t, UpdateContinue, rollback.FailureAction)
+
+	for i, value := range map[int]string{2: "-1", 4: "first", 7: "rollback"} {
+		old := vnfr.Configurations.ConfigurationParameters[i].Value
+		vnfr.Configurations.ConfigurationParameters[i].Value = value
+		_, err = FillConfig(vnfr, &cfg, log)
+		assert.Error(t, err, value)
+		vnfr.Configurations.ConfigurationParameters[i].Value = old
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	vnfr := &catalogue.VirtualNetworkFunctionRecord{
+		Name: "app",
+		Configurations: &catalogue.Configuration{
+			ConfigurationParameters: []*catalogue.ConfigurationParameter{
+				{ConfKey: "restart_policy", Value: "on-failure:3"},
+			},
+		},
+	}
+	cfg := NewVnfrConfig(vnfr)
+	_, err := FillConfig(vnfr, &cfg, log)
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Own)
+	assert.Equal(t, container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3}, cfg.Restart.containerPolicy(cfg.RestartPolicy))
+	for _, value := range []string{"sometimes", "always:3", "on-failure:-1"} {
+		vnfr.Configurations.ConfigurationParameters[0].Value = value
+		_, err = FillConfig(vnfr, &cfg, log)
+		assert.Error(t, err, value)
+	}
+
+	attempts := uint64(5)
+	assert.Equal(t, container.RestartPolicy{Name: "always"}, RestartOptions{}.containerPolicy("any"))
+	assert.Equal(t, container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 5}, RestartOptions{MaxAttempts: &attempts}.containerPolicy("on-failure"))
+	assert.Equal(t, container.RestartPolicy{Name: "unless-stopped"}, RestartOptions{Policy: "unless-stopped"}.containerPolicy("any"))
+	assert.Equal(t, container.RestartPolicy{}, RestartOptions{}.containerPolicy(""))
+
+	assert.Equal(t, "ACTIVE", vnfcState(&types.ContainerState{Running: true}))
+	assert.Equal(t, "INACTIVE", vnfcState(&types.ContainerState{Running: true, Paused: true}))
+	assert.Equal(t, "ERROR", vnfcState(&types.ContainerState{Running: true, Restarting: true}))
+	assert.Equal(t, "ERROR", vnfcState(&types.ContainerState{ExitCode: 137}))
+	assert.Equal(t, "INACTIVE", vnfcState(&types.ContainerState{}))
+}
+
+func TestWaits(t *testing.T) {
+	ctx := context.Background()
+	runs := 0
+	assert.NoError(t, poll(ctx, "three runs", func() (bool, error) {
+		runs++
+		return runs == 3, nil
+	}))
+	assert.Equal(t, 3, runs)
+	assert.EqualError(t, poll(ctx, "a failing inspect", func() (bool, error) {
+		return false, errors.New("inspect failed")
+	}), "inspect failed")
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, poll(timeout, "the virtual ips of service web", func() (bool, error) {
+		return false, nil
+	}), "timeout waiting for the virtual ips of service web")
+	// a docker call failing because the operation ended is reported as the timeout
+	assert.EqualError(t, poll(timeout, "the virtual ips of service web", func() (bool, error) {
+		return false, timeout.Err()
+	}), "timeout waiting for the virtual ips of service web")
+
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	assert.EqualError(t, poll(stopped, "service web", func() (bool, error) {
+		return false, nil
+	}), "stopped waiting for service web: context canceled")
+	assert.Error(t, sleep(stopped, time.Hour))
+
+	op, cancelOp := newOperation(0)
+	defer cancelOp()
+	deadline, ok := op.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(DefaultTimeout), deadline, time.Second)
+
+	healthy, err := containerHealthy("c", &types.ContainerState{Running: true}, false)
+	assert.False(t, healthy)
+	assert.NoError(t, err)
+	healthy, err = containerHealthy("c", &types.ContainerState{Running: true}, true)
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+	healthy, err = containerHealthy("c", &types.ContainerState{Running: true, Health: &types.Health{Status: "starting"}}, true)
+	assert.False(t, healthy)
+	assert.NoError(t, err)
+	healthy, err = containerHealthy("c", &types.ContainerState{Running: true, Health: &types.Health{Status: "healthy"}}, false)
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+	_, err = containerHealthy("c", &types.ContainerState{Running: true, Health: &types.Health{Status: "unhealthy"}}, false)
+	assert.EqualError(t, err, "container c is unhealthy")
+	_, err = containerHealthy("c", &types.ContainerState{ExitCode: 1}, false)
+	assert.Error(t, err)
+}
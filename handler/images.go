@@ -0,0 +1,354 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Pull policies of the pull_policy configuration parameter
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+const defaultRegistry = "docker.io"
+
+func validPullPolicy(policy string) bool {
+	return policy == PullAlways || policy == PullIfNotPresent || policy == PullNever
+}
+
+// RegistryCredentials are the credentials used to pull images from private registries. The
+// credentials of a vim instance, selected by name or id, take precedence over the global ones.
+//
+//	{
+//	  "registries": {"registry.example.org": {"username": "user", "password": "pass"}},
+//	  "vims": {"docker-vim": {"registry.example.org": {"identitytoken": "token"}}}
+//	}
+type RegistryCredentials struct {
+	Registries map[string]types.AuthConfig            `json:"registries"`
+	Vims       map[string]map[string]types.AuthConfig `json:"vims"`
+}
+
+// LoadRegistryCredentials reads the credentials file
+func LoadRegistryCredentials(path string) (*RegistryCredentials, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := &RegistryCredentials{}
+	if err := json.Unmarshal(content, creds); err != nil {
+		return nil, fmt.Errorf("invalid registry credentials file %s: %v", path, err)
+	}
+	res := &RegistryCredentials{
+		Registries: normalizeRegistries(creds.Registries),
+		Vims:       make(map[string]map[string]types.AuthConfig, len(creds.Vims)),
+	}
+	for vim, registries := range creds.Vims {
+		res.Vims[vim] = normalizeRegistries(registries)
+	}
+	return res, nil
+}
+
+func normalizeRegistries(registries map[string]types.AuthConfig) map[string]types.AuthConfig {
+	res := make(map[string]types.AuthConfig, len(registries))
+	for registry, auth := range registries {
+		res[normalizeRegistry(registry)] = auth
+	}
+	return res
+}
+
+// normalizeRegistry strips scheme and path from a registry address and maps the aliases of
+// the docker hub to docker.io
+func normalizeRegistry(registry string) string {
+	if strings.Contains(registry, "://") {
+		if u, err := url.Parse(registry); err == nil {
+			registry = u.Host
+		}
+	}
+	registry = strings.SplitN(registry, "/", 2)[0]
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return defaultRegistry
+	}
+	return registry
+}
+
+// registryOf returns the registry of an image reference, docker.io if none is specified
+func registryOf(image string) string {
+	i := strings.Index(image, "/")
+	if i == -1 {
+		return defaultRegistry
+	}
+	first := image[:i]
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return normalizeRegistry(first)
+	}
+	return defaultRegistry
+}
+
+// auth returns the encoded credentials for pulling the image on the vim instance, an empty
+// string if there are none
+func (c *RegistryCredentials) auth(vim *catalogue.DockerVimInstance, image string) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	registry := registryOf(image)
+	auth, ok := c.Vims[vim.Name][registry]
+	if !ok {
+		auth, ok = c.Vims[vim.ID][registry]
+	}
+	if !ok {
+		auth, ok = c.Registries[registry]
+	}
+	if !ok {
+		return "", nil
+	}
+	if auth.ServerAddress == "" {
+		auth.ServerAddress = registry
+	}
+	js, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(js), nil
+}
+
+// pullMessage is a line of the json stream returned by the image pull
+type pullMessage struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Error string `json:"error"`
+}
+
+// pullImage pulls the image logging the progress of every layer each time its status changes
+func pullImage(l *logging.Logger, cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, image string, creds *RegistryCredentials) error {
+	auth, err := creds.auth(vim, image)
+	if err != nil {
+		return err
+	}
+	l.Infof("Pulling image %s on %s", image, vim.Name)
+	body, err := cli.ImagePull(ctx, image, types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return logPullProgress(l, image, body)
+}
+
+func logPullProgress(l *logging.Logger, image string, body io.Reader) error {
+	status := make(map[string]string)
+	decoder := json.NewDecoder(body)
+	for {
+		msg := pullMessage{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("error pulling image %s: %s", image, msg.Error)
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return fmt.Errorf("error pulling image %s: %s", image, msg.ErrorDetail.Message)
+		}
+		if status[msg.ID] == msg.Status {
+			continue
+		}
+		status[msg.ID] = msg.Status
+		if msg.ID != "" {
+			l.Debugf("%s: %s: %s %s", image, msg.ID, msg.Status, msg.Progress)
+		} else {
+			l.Debugf("%s: %s", image, msg.Status)
+		}
+	}
+}
+
+// imagePresent checks the image on the docker daemon, falling back to the images known by the
+// vim instance when the daemon can not be asked
+func imagePresent(cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, image string) bool {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, image); err == nil {
+		return true
+	}
+	for _, img := range vim.Images {
+		if img.ID == image || arrayContains(img.Tags, image) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureImage makes the image available on the vim instance according to the pull policy
+func ensureImage(l *logging.Logger, cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, image, policy string, creds *RegistryCredentials) error {
+	if isImageID(image) {
+		// an image id can not be pulled
+		policy = PullNever
+	}
+	switch policy {
+	case PullNever:
+		if !imagePresent(cli, ctx, vim, image) {
+			return fmt.Errorf("image %s not present on %s and pull policy is %s", image, vim.Name, policy)
+		}
+		return nil
+	case PullAlways:
+		return pullImage(l, cli, ctx, vim, image, creds)
+	default:
+		if imagePresent(cli, ctx, vim, image) {
+			return nil
+		}
+		return pullImage(l, cli, ctx, vim, image, creds)
+	}
+}
+
+// chooseImage returns the first of the images that is available on the vim instance according
+// to the pull policy
+func chooseImage(l *logging.Logger, cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, imageNames []string, policy string, creds *RegistryCredentials) (string, error) {
+	if len(imageNames) == 0 {
+		return "", errors.New("no image provided")
+	}
+	if policy == PullIfNotPresent || policy == "" {
+		// prefer an image already present before pulling any
+		for _, image := range imageNames {
+			if imagePresent(cli, ctx, vim, image) {
+				return image, nil
+			}
+		}
+	}
+	errs := make([]string, 0, len(imageNames))
+	for _, image := range imageNames {
+		err := ensureImage(l, cli, ctx, vim, image, policy, creds)
+		if err == nil {
+			return image, nil
+		}
+		l.Warningf("Image %s is not available on %s: %v", image, vim.Name, err)
+		errs = append(errs, err.Error())
+	}
+	return "", fmt.Errorf("none of the images %v is available on %s: %s", imageNames, vim.Name, strings.Join(errs, "; "))
+}
+
+// chooseServiceImage returns the first of the images that the nodes of the swarm can run. The
+// nodes pull the image themselves, so only the presence on the manager is checked when pulling
+// is not allowed.
+func chooseServiceImage(cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, imageNames []string, policy string, creds *RegistryCredentials) (string, error) {
+	for _, image := range imageNames {
+		if policy == PullNever {
+			if imagePresent(cli, ctx, vim, image) {
+				return image, nil
+			}
+			continue
+		}
+		auth, err := creds.auth(vim, image)
+		if err != nil {
+			return "", err
+		}
+		if _, err := cli.DistributionInspect(ctx, image, auth); err == nil || imagePresent(cli, ctx, vim, image) {
+			return image, nil
+		}
+	}
+	return "", fmt.Errorf("none of the images %v is available on %s with pull policy %s", imageNames, vim.Name, policy)
+}
+
+// isImageID returns true for a reference to a local image id like sha256:abc
+func isImageID(image string) bool {
+	return strings.HasPrefix(image, "sha256:")
+}
+
+// repositoryOf strips the tag and the digest from an image reference
+func repositoryOf(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// pinImage resolves the image to an immutable reference like mongo@sha256:abc, using the repo
+// digests of the local image or, if there are none, the digest in the registry. Images never
+// pushed to a registry are not pinned, their local id would not be available on other vim
+// instances, the reference is returned unchanged.
+func pinImage(l *logging.Logger, cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, image string, creds *RegistryCredentials) (string, error) {
+	if strings.Contains(image, "@") || isImageID(image) {
+		return image, nil
+	}
+	repo := repositoryOf(image)
+	inspect, _, inspectErr := cli.ImageInspectWithRaw(ctx, image)
+	if inspectErr == nil {
+		for _, repoDigest := range inspect.RepoDigests {
+			if repositoryOf(repoDigest) == repo {
+				return repoDigest, nil
+			}
+		}
+	}
+	auth, err := creds.auth(vim, image)
+	if err != nil {
+		return "", err
+	}
+	distribution, err := cli.DistributionInspect(ctx, image, auth)
+	if err == nil && distribution.Descriptor.Digest != "" {
+		return fmt.Sprintf("%s@%s", repo, distribution.Descriptor.Digest), nil
+	}
+	l.Warningf("Unable to resolve the digest of image %s, it will not be pinned", image)
+	return image, nil
+}
+
+const imageDigestKey = "image_digest"
+
+// reportImage sets the configuration parameter <hostname>.image_digest of the VNFR to the
+// pinned image running in the VNFC Instance
+func reportImage(vnfr *catalogue.VirtualNetworkFunctionRecord, hostname, image string) {
+	reportParameter(vnfr, fmt.Sprintf("%s.%s", hostname, imageDigestKey), image, "Image running in the VNFC Instance "+hostname)
+}
+
+// removeImageReport removes the image_digest configuration parameter of a VNFC Instance
+func removeImageReport(vnfr *catalogue.VirtualNetworkFunctionRecord, hostname string) {
+	removeParameter(vnfr, fmt.Sprintf("%s.%s", hostname, imageDigestKey))
+}
+
+// reportParameter sets a configuration parameter of the VNFR, adding it if missing
+func reportParameter(vnfr *catalogue.VirtualNetworkFunctionRecord, key, value, description string) {
+	if vnfr.Configurations == nil {
+		vnfr.Configurations = &catalogue.Configuration{}
+	}
+	for _, cp := range vnfr.Configurations.ConfigurationParameters {
+		if cp.ConfKey == key {
+			cp.Value = value
+			return
+		}
+	}
+	vnfr.Configurations.ConfigurationParameters = append(vnfr.Configurations.ConfigurationParameters, &catalogue.ConfigurationParameter{
+		ConfKey:     key,
+		Value:       value,
+		Description: description,
+	})
+}
+
+// removeParameter removes a configuration parameter of the VNFR
+func removeParameter(vnfr *catalogue.VirtualNetworkFunctionRecord, key string) {
+	if vnfr.Configurations == nil {
+		return
+	}
+	params := vnfr.Configurations.ConfigurationParameters[:0]
+	for _, cp := range vnfr.Configurations.ConfigurationParameters {
+		if cp.ConfKey != key {
+			params = append(params, cp)
+		}
+	}
+	vnfr.Configurations.ConfigurationParameters = params
+}
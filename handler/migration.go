@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/container"
+	"docker.io/go-docker/api/types/mount"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"path"
+	"strings"
+	"time"
+)
+
+// checkpointDir is the directory on the docker hosts where the checkpoints of the migrated
+// containers are written
+const checkpointDir = "/var/lib/openbaton/checkpoints"
+
+// migratePrefix starts the cause of a heal request migrating a VNFC Instance
+const migratePrefix = "migrate:"
+
+// checkpointRestore makes startContainer restore the new container from a checkpoint
+type checkpointRestore struct {
+	ID  string
+	Dir string
+	// prepare copies the checkpoint, and the volumes, to the created container
+	prepare func(cl *docker.Client, containerID string) error
+}
+
+// parseMigration parses the cause migrate:<vim instance>[:volumes] of a heal request, the vim
+// instance is its name or id
+func parseMigration(cause string) (string, bool, bool) {
+	if !strings.HasPrefix(cause, migratePrefix) {
+		return "", false, false
+	}
+	split := strings.Split(strings.TrimPrefix(cause, migratePrefix), ":")
+	volumes := len(split) > 1 && split[1] == "volumes"
+	return split[0], volumes, split[0] != ""
+}
+
+// migrate moves the VNFC Instance to the vim instance target keeping the memory of its processes.
+// The container is checkpointed with CRIU, which needs docker in experimental mode on both hosts,
+// and restored in a container created with the same configuration on the target. The source
+// container is started again from the checkpoint if the restore fails.
+func (h *VnfmImpl) migrate(ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, cfg *VnfrConfig, vduID string, vnfc *catalogue.VNFCInstance, target string, volumes bool) error {
+	source := cfg.vimOf(vduID, vnfc.VIMID)
+	var dest *catalogue.DockerVimInstance
+	for _, vim := range cfg.vduVims(vduID) {
+		if vim.ID == target || vim.Name == target {
+			dest = vim
+		}
+	}
+	if dest == nil {
+		return fmt.Errorf("vim instance %s is not a candidate of VDU %s", target, vduID)
+	}
+	if dest.ID == source.ID {
+		return fmt.Errorf("VNFC Instance %s already runs on %s", vnfc.Hostname, dest.Name)
+	}
+	scl, err := getClient(source, h.CertFolder, h.Tsl)
+	if err != nil {
+		return err
+	}
+	dcl, err := getClient(dest, h.CertFolder, h.Tsl)
+	if err != nil {
+		return err
+	}
+	image := cfg.Vdu(vduID).image()
+	if err := ensureImage(h.Logger, dcl, ctx, dest, image, cfg.PullPolicy, h.Credentials); err != nil {
+		return err
+	}
+	secrets, err := resolveSecrets(h.Secrets, vnfr, cfg.Secrets)
+	if err != nil {
+		return err
+	}
+	old := vnfc.VCID
+	c, err := scl.ContainerInspect(ctx, old)
+	if err != nil {
+		return err
+	}
+
+	checkpoint := fmt.Sprintf("migrate-%d", time.Now().Unix())
+	dir := path.Join(checkpointDir, cfg.VnfrID)
+	h.Logger.Noticef("%s: Migrating VNFC Instance %s from %s to %s", cfg.Name, vnfc.Hostname, source.Name, dest.Name)
+	err = scl.CheckpointCreate(ctx, old, types.CheckpointCreateOptions{
+		CheckpointID:  checkpoint,
+		CheckpointDir: dir,
+		Exit:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to checkpoint container %s, docker must run in experimental mode with criu installed: %v", old, err)
+	}
+	restore := &checkpointRestore{
+		ID:  checkpoint,
+		Dir: dir,
+		prepare: func(cl *docker.Client, containerID string) error {
+			if err := copyCheckpoint(scl, cl, ctx, image, dir, checkpoint); err != nil {
+				return err
+			}
+			if volumes {
+				return copyVolumes(ctx, scl, old, cl, containerID, c.Mounts)
+			}
+			return nil
+		},
+	}
+	id, ips, fips, name, err := h.startContainer(ctx, *cfg, vduID, dest, firstNet(vnfc), vnfcScope(vnfc), secrets, restore)
+	if err != nil {
+		h.Logger.Errorf("%s: Restore on %s failed, restarting container %s: %v", cfg.Name, dest.Name, old, err)
+		rerr := scl.ContainerStart(ctx, old, types.ContainerStartOptions{CheckpointID: checkpoint, CheckpointDir: dir})
+		if rerr != nil {
+			rerr = scl.ContainerStart(ctx, old, types.ContainerStartOptions{})
+		}
+		if rerr == nil {
+			rerr = writeSecrets(scl, ctx, old, secrets)
+		}
+		if rerr != nil {
+			h.Logger.Errorf("%s: Unable to restart container %s: %v", cfg.Name, old, rerr)
+		}
+		return fmt.Errorf("migration of VNFC Instance %s to %s failed: %v", vnfc.Hostname, dest.Name, err)
+	}
+
+	for _, cp := range []struct {
+		cli *docker.Client
+		id  string
+	}{{scl, old}, {dcl, id}} {
+		if err := cp.cli.CheckpointDelete(ctx, cp.id, types.CheckpointDeleteOptions{CheckpointID: checkpoint, CheckpointDir: dir}); err != nil {
+			h.Logger.Warningf("%s: Unable to delete checkpoint %s of container %s: %v", cfg.Name, checkpoint, cp.id, err)
+		}
+	}
+	if err := scl.ContainerRemove(ctx, old, types.ContainerRemoveOptions{Force: true}); err != nil {
+		h.Logger.Warningf("%s: Error while removing container %s: %v", cfg.Name, old, err)
+	}
+	cfg.ContainerIDs[vduID] = removeString(cfg.ContainerIDs[vduID], old)
+	delete(cfg.ContainerVim, old)
+	delete(cfg.Paused, old)
+	removeContainerReports(vnfr, vnfc.Hostname)
+	vnfc.VIMID = dest.ID
+	setVnfcContainer(vnfr, vnfc, image, id, name, ips, fips)
+	h.Logger.Noticef("%s: VNFC Instance %s runs in container %s on %s", cfg.Name, vnfc.Hostname, id, dest.Name)
+	return nil
+}
+
+// checkpointHelper creates a container, never started, giving access to the checkpoint directory
+// of the docker host
+func checkpointHelper(cli *docker.Client, ctx context.Context, image, dir string) (string, error) {
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Entrypoint: []string{"/checkpoint-helper"},
+	}, &container.HostConfig{
+		// unlike a mount, a bind creates the missing directory
+		Binds: []string{dir + ":/checkpoints"},
+	}, nil, "")
+	return resp.ID, err
+}
+
+// copyCheckpoint copies the checkpoint between the docker hosts
+func copyCheckpoint(src, dst *docker.Client, ctx context.Context, image, dir, checkpoint string) error {
+	srcHelper, err := checkpointHelper(src, ctx, image, dir)
+	if err != nil {
+		return err
+	}
+	defer src.ContainerRemove(ctx, srcHelper, types.ContainerRemoveOptions{Force: true})
+	dstHelper, err := checkpointHelper(dst, ctx, image, dir)
+	if err != nil {
+		return err
+	}
+	defer dst.ContainerRemove(ctx, dstHelper, types.ContainerRemoveOptions{Force: true})
+	content, _, err := src.CopyFromContainer(ctx, srcHelper, path.Join("/checkpoints", checkpoint))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return dst.CopyToContainer(ctx, dstHelper, "/checkpoints", content, types.CopyToContainerOptions{})
+}
+
+// copyVolumes copies the content of the bind mounts and volumes of the source container to the
+// same paths of the created container
+func copyVolumes(ctx context.Context, src *docker.Client, srcID string, dst *docker.Client, dstID string, mounts []types.MountPoint) error {
+	for _, m := range mounts {
+		if m.Type != mount.TypeVolume && m.Type != mount.TypeBind {
+			continue
+		}
+		content, _, err := src.CopyFromContainer(ctx, srcID, m.Destination)
+		if err != nil {
+			return err
+		}
+		err = dst.CopyToContainer(ctx, dstID, path.Dir(m.Destination), content, types.CopyToContainerOptions{})
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("unable to copy volume %s: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
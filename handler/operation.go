@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultTimeout is the deadline of a lifecycle operation of a handler without Timeout
+const DefaultTimeout = 10 * time.Minute
+
+// Bounds of the backoff between the checks of poll
+const (
+	minPollInterval = 50 * time.Millisecond
+	maxPollInterval = 2 * time.Second
+)
+
+// newOperation returns the context of a lifecycle operation, every docker call of the operation
+// is cancelled after the timeout
+func newOperation(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// cleanupTimeout is the deadline of the cleanups run after a failed operation
+const cleanupTimeout = 30 * time.Second
+
+// newCleanup returns the context of a cleanup, it does not depend on the one of the operation
+// which may have expired
+func newCleanup() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// poll runs check, doubling the interval between the runs up to maxPollInterval, until it is
+// done or fails. If the context ends first the error describes what was waited for.
+func poll(ctx context.Context, what string, check func() (bool, error)) error {
+	interval := minPollInterval
+	for {
+		done, err := check()
+		if err == nil && done {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return waitError(ctx, what)
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return waitError(ctx, what)
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+}
+
+// waitError returns the error of a wait ended by the context
+func waitError(ctx context.Context, what string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timeout waiting for %s", what)
+	}
+	return fmt.Errorf("stopped waiting for %s: %v", what, ctx.Err())
+}
+
+// sleep waits for the duration, unless the context ends first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// withTimeout bounds a wait of the operation by its own timeout, the deadline of the operation
+// still applies
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
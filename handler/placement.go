@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/filters"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels set on every container started by the VNFM
+const (
+	labelVnfm     = "org.openbaton.vnfm"
+	labelVnfrID   = "org.openbaton.vnfr.id"
+	labelVnfrName = "org.openbaton.vnfr.name"
+	labelVduID    = "org.openbaton.vdu.id"
+	labelMemory   = "org.openbaton.resources.memory"
+	labelNanoCPUs = "org.openbaton.resources.nano-cpus"
+)
+
+// PlacementRequest describes the resources and the labels of the VNFC Instance to place
+type PlacementRequest struct {
+	Memory       int64
+	NanoCPUs     int64
+	Labels       map[string]string
+	Affinity     map[string]string
+	AntiAffinity map[string]string
+}
+
+// VimCandidate is a vim instance on which a VNFC Instance can be placed, together with the
+// resources and the labels of the containers it is already running
+type VimCandidate struct {
+	Vim          *catalogue.DockerVimInstance
+	Containers   int
+	MemTotal     int64
+	NanoCPUs     int64
+	UsedMemory   int64
+	UsedNanoCPUs int64
+	Labels       []map[string]string
+}
+
+func (c *VimCandidate) FreeMemory() int64 {
+	return c.MemTotal - c.UsedMemory
+}
+
+func (c *VimCandidate) FreeNanoCPUs() int64 {
+	return c.NanoCPUs - c.UsedNanoCPUs
+}
+
+func (c *VimCandidate) fits(req PlacementRequest) bool {
+	return (req.Memory == 0 || req.Memory <= c.FreeMemory()) && (req.NanoCPUs == 0 || req.NanoCPUs <= c.FreeNanoCPUs())
+}
+
+// runs returns true if at least one container has one of the labels
+func (c *VimCandidate) runs(labels map[string]string) bool {
+	for _, containerLabels := range c.Labels {
+		for k, v := range labels {
+			if containerLabels[k] == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *VimCandidate) add(req PlacementRequest) {
+	c.Containers++
+	c.UsedMemory += req.Memory
+	c.UsedNanoCPUs += req.NanoCPUs
+	c.Labels = append(c.Labels, req.Labels)
+}
+
+// PlacementStrategy chooses one of the eligible vim instances, all of them fit the request
+type PlacementStrategy interface {
+	Choose(candidates []*VimCandidate, req PlacementRequest) *VimCandidate
+}
+
+var placementStrategies = map[string]func() PlacementStrategy{
+	"random":      func() PlacementStrategy { return randomStrategy{} },
+	"round-robin": func() PlacementStrategy { return &roundRobinStrategy{} },
+	"spread":      func() PlacementStrategy { return spreadStrategy{} },
+	"binpack":     func() PlacementStrategy { return binpackStrategy{} },
+}
+
+// RegisterPlacementStrategy makes a strategy available to the placement configuration parameter
+func RegisterPlacementStrategy(name string, newStrategy func() PlacementStrategy) {
+	placementStrategies[name] = newStrategy
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Choose(candidates []*VimCandidate, req PlacementRequest) *VimCandidate {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+type roundRobinStrategy struct {
+	next int
+}
+
+func (s *roundRobinStrategy) Choose(candidates []*VimCandidate, req PlacementRequest) *VimCandidate {
+	c := candidates[s.next%len(candidates)]
+	s.next++
+	return c
+}
+
+// spreadStrategy chooses the vim instance running less containers
+type spreadStrategy struct{}
+
+func (spreadStrategy) Choose(candidates []*VimCandidate, req PlacementRequest) *VimCandidate {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Containers < best.Containers || (c.Containers == best.Containers && c.FreeMemory() > best.FreeMemory()) {
+			best = c
+		}
+	}
+	return best
+}
+
+// binpackStrategy chooses the vim instance with less free memory and cpu
+type binpackStrategy struct{}
+
+func (binpackStrategy) Choose(candidates []*VimCandidate, req PlacementRequest) *VimCandidate {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.FreeMemory() < best.FreeMemory() || (c.FreeMemory() == best.FreeMemory() && c.FreeNanoCPUs() < best.FreeNanoCPUs()) {
+			best = c
+		}
+	}
+	return best
+}
+
+// placement places the VNFC Instances of a VDU one by one on the candidate vim instances
+type placement struct {
+	l          *logging.Logger
+	strategy   PlacementStrategy
+	candidates []*VimCandidate
+}
+
+func newPlacement(l *logging.Logger, ctx context.Context, strategyName string, vims []*catalogue.DockerVimInstance, certFolder string, tsl bool) (*placement, error) {
+	if strategyName == "" {
+		strategyName = "random"
+	}
+	newStrategy, ok := placementStrategies[strings.ToLower(strategyName)]
+	if !ok {
+		return nil, fmt.Errorf("unknown placement strategy %s", strategyName)
+	}
+	p := &placement{
+		l:          l,
+		strategy:   newStrategy(),
+		candidates: make([]*VimCandidate, 0, len(vims)),
+	}
+	for _, vim := range vims {
+		c, err := loadCandidate(ctx, vim, certFolder, tsl)
+		if err != nil {
+			l.Warningf("Vim Instance %s is not a placement candidate: %v", vim.Name, err)
+			continue
+		}
+		p.candidates = append(p.candidates, c)
+	}
+	if len(p.candidates) == 0 {
+		return nil, errors.New("no reachable vim instance available")
+	}
+	return p, nil
+}
+
+func loadCandidate(ctx context.Context, vim *catalogue.DockerVimInstance, certFolder string, tsl bool) (*VimCandidate, error) {
+	cl, err := getClient(vim, certFolder, tsl)
+	if err != nil {
+		return nil, err
+	}
+	info, err := cl.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := filters.NewArgs()
+	args.Add("label", labelVnfm)
+	containers, err := cl.ContainerList(ctx, types.ContainerListOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &VimCandidate{
+		Vim:        vim,
+		Containers: info.ContainersRunning,
+		MemTotal:   info.MemTotal,
+		NanoCPUs:   int64(info.NCPU) * 1e9,
+		Labels:     make([]map[string]string, 0, len(containers)),
+	}
+	for _, cont := range containers {
+		mem, _ := strconv.ParseInt(cont.Labels[labelMemory], 10, 64)
+		cpus, _ := strconv.ParseInt(cont.Labels[labelNanoCPUs], 10, 64)
+		c.UsedMemory += mem
+		c.UsedNanoCPUs += cpus
+		c.Labels = append(c.Labels, cont.Labels)
+	}
+	return c, nil
+}
+
+// place chooses the vim instance for the next VNFC Instance and records the decision
+func (p *placement) place(req PlacementRequest) (*catalogue.DockerVimInstance, error) {
+	eligible := make([]*VimCandidate, 0, len(p.candidates))
+	for _, c := range p.candidates {
+		if c.fits(req) && (len(req.AntiAffinity) == 0 || !c.runs(req.AntiAffinity)) {
+			eligible = append(eligible, c)
+		}
+	}
+	if len(req.Affinity) > 0 {
+		affine := make([]*VimCandidate, 0, len(eligible))
+		for _, c := range eligible {
+			if c.runs(req.Affinity) {
+				affine = append(affine, c)
+			}
+		}
+		// affinity is ignored until the first matching container is placed
+		if len(affine) > 0 {
+			eligible = affine
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, fmt.Errorf("no vim instance satisfies memory %d, nano cpus %d and anti affinity %v", req.Memory, req.NanoCPUs, req.AntiAffinity)
+	}
+	c := p.strategy.Choose(eligible, req)
+	c.add(req)
+	p.l.Debugf("Placed VNFC Instance with labels %v on Vim Instance %s", req.Labels, c.Vim.Name)
+	return c.Vim, nil
+}
+
+// resume continues a round-robin placement from the position where the previous placement of
+// the VDU stopped, other strategies do not depend on the previous placements
+func (p *placement) resume(next int) {
+	if rr, ok := p.strategy.(*roundRobinStrategy); ok {
+		rr.next = next
+	}
+}
+
+// position returns the position to resume the next placement of the VDU from
+func (p *placement) position() int {
+	if rr, ok := p.strategy.(*roundRobinStrategy); ok {
+		return rr.next
+	}
+	return 0
+}
+
+// ParseLabels parses a list like key1=value1;key2=value2
+func ParseLabels(value string) map[string]string {
+	res := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		split := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if split[0] == "" {
+			continue
+		}
+		if len(split) == 2 {
+			res[split[0]] = split[1]
+		} else {
+			res[split[0]] = ""
+		}
+	}
+	return res
+}
+
+// containerLabels returns the labels of the containers of a VDU
+func containerLabels(cfg VnfrConfig, vduID string) map[string]string {
+	labels := make(map[string]string, len(cfg.Labels)+6)
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	labels[labelVnfm] = "docker"
+	labels[labelVnfrID] = cfg.VnfrID
+	labels[labelVnfrName] = cfg.Name
+	labels[labelVduID] = vduID
+	if cfg.Memory > 0 {
+		labels[labelMemory] = strconv.FormatInt(cfg.Memory, 10)
+	}
+	if cfg.NanoCPUs > 0 {
+		labels[labelNanoCPUs] = strconv.FormatInt(cfg.NanoCPUs, 10)
+	}
+	return labels
+}
+
+func placementRequest(cfg VnfrConfig, vduID string) PlacementRequest {
+	return PlacementRequest{
+		Memory:       cfg.Memory,
+		NanoCPUs:     cfg.NanoCPUs,
+		Labels:       containerLabels(cfg, vduID),
+		Affinity:     cfg.Affinity,
+		AntiAffinity: cfg.AntiAffinity,
+	}
+}
+
+// dockerVimInstances converts the vim instances received by the nfvo, sorted by name
+func dockerVimInstances(vimInstances []interface{}) []*catalogue.DockerVimInstance {
+	res := make([]*catalogue.DockerVimInstance, 0, len(vimInstances))
+	for _, vim := range vimInstances {
+		if dockerVim, ok := vim.(*catalogue.DockerVimInstance); ok {
+			res = append(res, dockerVim)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
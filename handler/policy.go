@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ImagePolicy restricts the images the VNFM deploys. The rule of the project of the VNFR is
+// applied, or the default rule if the project has none; without any rule every image is allowed.
+//
+//	{
+//	  "keys": {"team": "/etc/openbaton/keys/team.pem"},
+//	  "signatures_dir": "/etc/openbaton/signatures",
+//	  "default": {"registries": ["registry.example.org"], "repositories": ["docker.io/library/*"]},
+//	  "projects": {"<project id>": {"repositories": ["registry.example.org/team/**"], "signed_by": ["team"]}}
+//	}
+type ImagePolicy struct {
+	Keys          map[string]string           `json:"keys"`
+	SignaturesDir string                      `json:"signatures_dir"`
+	Default       *ImagePolicyRule            `json:"default"`
+	Projects      map[string]*ImagePolicyRule `json:"projects"`
+	publicKeys    map[string]crypto.PublicKey
+}
+
+// ImagePolicyRule allows the images of the registries and of the repositories matching one of the
+// patterns, like docker.io/library/* or registry.example.org/team/**. If SignedBy is not empty the
+// digest of the image must be signed by one of these keys.
+type ImagePolicyRule struct {
+	Registries   []string `json:"registries"`
+	Repositories []string `json:"repositories"`
+	SignedBy     []string `json:"signed_by"`
+}
+
+// PolicyViolation is returned when an image is rejected by the image policy
+type PolicyViolation struct {
+	Project string
+	Image   string
+	Reason  string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("image %s violates the image policy of project %s: %s", v.Image, v.Project, v.Reason)
+}
+
+// LoadImagePolicy reads the policy file and the public keys it refers to
+func LoadImagePolicy(file string) (*ImagePolicy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &ImagePolicy{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("invalid image policy file %s: %v", file, err)
+	}
+	p.publicKeys = make(map[string]crypto.PublicKey, len(p.Keys))
+	for name, keyFile := range p.Keys {
+		key, err := loadPublicKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", name, err)
+		}
+		p.publicKeys[name] = key
+	}
+	rules := []*ImagePolicyRule{p.Default}
+	for _, rule := range p.Projects {
+		rules = append(rules, rule)
+	}
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		for _, name := range rule.SignedBy {
+			if _, ok := p.publicKeys[name]; !ok {
+				return nil, fmt.Errorf("unknown key %s in image policy", name)
+			}
+		}
+		if len(rule.SignedBy) > 0 && p.SignaturesDir == "" {
+			return nil, fmt.Errorf("signatures_dir is required to verify the signatures of %v", rule.SignedBy)
+		}
+	}
+	return p, nil
+}
+
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T in %s", key, file)
+}
+
+func (p *ImagePolicy) rule(projectID string) *ImagePolicyRule {
+	if rule, ok := p.Projects[projectID]; ok {
+		return rule
+	}
+	return p.Default
+}
+
+// allowed returns the images allowed for the project, an error if there are none
+func (p *ImagePolicy) allowed(projectID string, images []string) ([]string, error) {
+	if p == nil || p.rule(projectID) == nil {
+		return images, nil
+	}
+	rule := p.rule(projectID)
+	res := make([]string, 0, len(images))
+	for _, image := range images {
+		if rule.allows(image) {
+			res = append(res, image)
+		}
+	}
+	if len(res) == 0 {
+		return nil, &PolicyViolation{
+			Project: projectID,
+			Image:   strings.Join(images, ","),
+			Reason:  "neither the registry nor the repository is allowed",
+		}
+	}
+	return res, nil
+}
+
+func (r *ImagePolicyRule) allows(image string) bool {
+	if len(r.Registries) == 0 && len(r.Repositories) == 0 {
+		return true
+	}
+	registry := registryOf(image)
+	for _, allowed := range r.Registries {
+		if normalizeRegistry(allowed) == registry {
+			return true
+		}
+	}
+	repo := fullRepository(image)
+	for _, pattern := range r.Repositories {
+		if strings.HasSuffix(pattern, "/**") && strings.HasPrefix(repo, strings.TrimSuffix(pattern, "**")) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fullRepository returns the repository of the image including the registry, e.g.
+// docker.io/library/mongo for mongo:latest
+func fullRepository(image string) string {
+	repo := repositoryOf(image)
+	registry := registryOf(image)
+	if split := strings.SplitN(repo, "/", 2); len(split) == 2 && normalizeRegistry(split[0]) == registry {
+		repo = split[1]
+	}
+	if registry == defaultRegistry && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return registry + "/" + repo
+}
+
+// verify checks that the digest of the pinned image is signed by one of the keys required by
+// the rule of the project. The signatures are files named after the digest, like
+// sha256-<hex>.sig or sha256-<hex>.<suffix>.sig, in the signatures directory, containing the
+// raw or base64 encoded signature of the digest string sha256:<hex>.
+func (p *ImagePolicy) verify(projectID, image string) error {
+	if p == nil || p.rule(projectID) == nil || len(p.rule(projectID).SignedBy) == 0 {
+		return nil
+	}
+	violation := &PolicyViolation{Project: projectID, Image: image}
+	split := strings.SplitN(image, "@", 2)
+	if len(split) != 2 {
+		violation.Reason = "the image is not pinned to a registry digest, its signature can not be verified"
+		return violation
+	}
+	digest := split[1]
+	pattern := filepath.Join(p.SignaturesDir, strings.Replace(digest, ":", "-", 1)+"*.sig")
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		violation.Reason = fmt.Sprintf("no signature found for digest %s", digest)
+		return violation
+	}
+	for _, file := range files {
+		sig, err := readSignature(file)
+		if err != nil {
+			continue
+		}
+		for _, name := range p.rule(projectID).SignedBy {
+			if verifySignature(p.publicKeys[name], []byte(digest), sig) {
+				return nil
+			}
+		}
+	}
+	violation.Reason = fmt.Sprintf("digest %s is not signed by any of the keys %v", digest, p.rule(projectID).SignedBy)
+	return violation
+}
+
+func readSignature(file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); err == nil {
+		return decoded, nil
+	}
+	return content, nil
+}
+
+// verifySignature verifies a RSA PKCS#1 v1.5 or an ASN.1 encoded ECDSA signature of the sha256
+// of the payload
+func verifySignature(key crypto.PublicKey, payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) != 0 {
+			return false
+		}
+		return ecdsa.Verify(key, hash[:], esig.R, esig.S)
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"docker.io/go-docker/api/types/swarm"
+	"errors"
+	"fmt"
+	"github.com/docker/go-connections/nat"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortMapping is a single published port, as obtained by parsing the docker -p syntax
+// ip:hostPort:containerPort/proto. HostPort is empty when the host port is chosen by docker
+// and may be a range (8000-8010) when a single container port is bound in a dynamic range.
+type PortMapping struct {
+	HostIP        string
+	HostPort      string
+	ContainerPort string
+	Protocol      string
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%s:%s:%s/%s", p.HostIP, p.HostPort, p.ContainerPort, p.Protocol)
+}
+
+var validProtocols = []string{"tcp", "udp", "sctp"}
+
+// ParsePortSpec parses a publish value like 80, 8080:80, 8080:80/udp, 127.0.0.1:8080:80/tcp,
+// 7000-7010:7000-7010 or [::1]::80/sctp, expanding port ranges in one mapping per port
+func ParsePortSpec(spec string) ([]PortMapping, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("empty port specification")
+	}
+	rawIP, hostPort, containerPort := splitPortSpec(spec)
+
+	proto := "tcp"
+	if i := strings.LastIndex(containerPort, "/"); i >= 0 {
+		if containerPort[i+1:] != "" {
+			proto = strings.ToLower(containerPort[i+1:])
+		}
+		containerPort = containerPort[:i]
+	}
+	if !arrayContains(validProtocols, proto) {
+		return nil, fmt.Errorf("invalid protocol %s in port specification %s", proto, spec)
+	}
+
+	ip := strings.TrimSuffix(strings.TrimPrefix(rawIP, "["), "]")
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid ip address %s in port specification %s", ip, spec)
+	}
+	if containerPort == "" {
+		return nil, fmt.Errorf("no container port in port specification %s", spec)
+	}
+
+	start, end, err := nat.ParsePortRange(containerPort)
+	if err != nil || start == 0 {
+		return nil, fmt.Errorf("invalid container port %s in port specification %s", containerPort, spec)
+	}
+	var hostStart, hostEnd uint64
+	if hostPort != "" {
+		hostStart, hostEnd, err = nat.ParsePortRange(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port %s in port specification %s", hostPort, spec)
+		}
+		if end-start != hostEnd-hostStart && end != start {
+			return nil, fmt.Errorf("container port range %s and host port range %s have different sizes", containerPort, hostPort)
+		}
+	}
+
+	mappings := make([]PortMapping, 0, end-start+1)
+	for i := uint64(0); i <= end-start; i++ {
+		mapping := PortMapping{
+			HostIP:        ip,
+			ContainerPort: strconv.FormatUint(start+i, 10),
+			Protocol:      proto,
+		}
+		if hostPort != "" {
+			if start == end && hostStart != hostEnd {
+				mapping.HostPort = fmt.Sprintf("%d-%d", hostStart, hostEnd)
+			} else {
+				mapping.HostPort = strconv.FormatUint(hostStart+i, 10)
+			}
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// ParsePortSpecs parses a list of publish values separated by ';'
+func ParsePortSpecs(value string) ([]PortMapping, error) {
+	res := make([]PortMapping, 0)
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		mappings, err := ParsePortSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, mappings...)
+	}
+	return res, nil
+}
+
+func splitPortSpec(spec string) (string, string, string) {
+	parts := strings.Split(spec, ":")
+	n := len(parts)
+	switch n {
+	case 1:
+		return "", "", parts[0]
+	case 2:
+		return "", parts[0], parts[1]
+	case 3:
+		return parts[0], parts[1], parts[2]
+	default:
+		// ipv6 address
+		return strings.Join(parts[:n-2], ":"), parts[n-2], parts[n-1]
+	}
+}
+
+func toPortBindings(ports []PortMapping) (nat.PortSet, nat.PortMap, error) {
+	exposed := make(nat.PortSet)
+	bindings := make(nat.PortMap)
+	for _, p := range ports {
+		port, err := nat.NewPort(p.Protocol, p.ContainerPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		hostIP := p.HostIP
+		if hostIP == "" {
+			hostIP = "0.0.0.0"
+		}
+		exposed[port] = struct{}{}
+		bindings[port] = append(bindings[port], nat.PortBinding{
+			HostIP:   hostIP,
+			HostPort: p.HostPort,
+		})
+	}
+	return exposed, bindings, nil
+}
+
+func toSwarmPorts(ports []PortMapping, publishMode string) ([]swarm.PortConfig, error) {
+	mode := swarm.PortConfigPublishModeIngress
+	switch strings.ToLower(publishMode) {
+	case "", "ingress":
+	case "host":
+		mode = swarm.PortConfigPublishModeHost
+	default:
+		return nil, fmt.Errorf("invalid publish mode %s, must be ingress or host", publishMode)
+	}
+	res := make([]swarm.PortConfig, len(ports))
+	for i, p := range ports {
+		if p.HostIP != "" {
+			return nil, fmt.Errorf("binding to host ip %s is not supported by swarm services", p.HostIP)
+		}
+		target, err := strconv.ParseUint(p.ContainerPort, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		var published uint64
+		if p.HostPort != "" {
+			published, err = strconv.ParseUint(p.HostPort, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("host port range %s is not supported by swarm services", p.HostPort)
+			}
+		}
+		res[i] = swarm.PortConfig{
+			Protocol:      swarm.PortConfigProtocol(p.Protocol),
+			TargetPort:    uint32(target),
+			PublishedPort: uint32(published),
+			PublishMode:   mode,
+		}
+	}
+	return res, nil
+}
+
+// publishedPortIPs returns one entry per published port with the port key as net name,
+// 80/tcp, and the host address as ip, 0.0.0.0:32768
+func publishedPortIPs(bindings nat.PortMap) []*catalogue.IP {
+	res := make([]*catalogue.IP, 0)
+	for port, binds := range bindings {
+		for _, b := range binds {
+			if b.HostPort == "" || strings.Contains(b.HostPort, "-") {
+				continue
+			}
+			res = append(res, &catalogue.IP{
+				NetName: string(port),
+				IP:      net.JoinHostPort(b.HostIP, b.HostPort),
+			})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].NetName < res[j].NetName
+	})
+	return res
+}
+
+func publishedServicePortIPs(ports []swarm.PortConfig) []*catalogue.IP {
+	res := make([]*catalogue.IP, 0)
+	for _, p := range ports {
+		if p.PublishedPort == 0 {
+			continue
+		}
+		res = append(res, &catalogue.IP{
+			NetName: fmt.Sprintf("%d/%s", p.TargetPort, p.Protocol),
+			IP:      net.JoinHostPort("0.0.0.0", strconv.FormatUint(uint64(p.PublishedPort), 10)),
+		})
+	}
+	return res
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/container"
+	"docker.io/go-docker/api/types/swarm"
+	"errors"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys of the configuration parameters reporting the restarts of the container of a VNFC
+// Instance, as <hostname>.restart_count and <hostname>.exit_code
+const (
+	restartCountKey = "restart_count"
+	exitCodeKey     = "exit_code"
+)
+
+// RestartOptions holds the restart_delay, restart_max_attempts and restart_window configuration
+// parameters of the swarm services, swarm uses its defaults for the ones not configured, and the
+// restart_policy of the standalone containers
+type RestartOptions struct {
+	Delay       *time.Duration
+	MaxAttempts *uint64
+	Window      *time.Duration
+	Policy      string
+}
+
+func (o *RestartOptions) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "restart_policy":
+		_, err = parseRestartPolicy(value)
+		o.Policy = value
+	case "restart_delay":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		o.Delay = &d
+	case "restart_max_attempts":
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 64)
+		o.MaxAttempts = &n
+	case "restart_window":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		o.Window = &d
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %s of %s: %v", value, key, err)
+	}
+	return true, nil
+}
+
+// swarmPolicy returns the restart policy of the tasks with the restart_policy_condition, the
+// tasks are not restarted if it is not on-failure nor any
+func (o RestartOptions) swarmPolicy(condition string) *swarm.RestartPolicy {
+	p := &swarm.RestartPolicy{
+		Condition:   swarm.RestartPolicyConditionNone,
+		Delay:       o.Delay,
+		MaxAttempts: o.MaxAttempts,
+		Window:      o.Window,
+	}
+	if condition == "on-failure" {
+		p.Condition = swarm.RestartPolicyConditionOnFailure
+	} else if condition == "any" {
+		p.Condition = swarm.RestartPolicyConditionAny
+	}
+	return p
+}
+
+// parseRestartPolicy parses a restart policy of the docker run syntax: no, on-failure[:max],
+// always or unless-stopped
+func parseRestartPolicy(value string) (container.RestartPolicy, error) {
+	split := strings.SplitN(value, ":", 2)
+	p := container.RestartPolicy{Name: split[0]}
+	switch p.Name {
+	case "", "no", "always", "unless-stopped":
+		if len(split) > 1 {
+			return p, fmt.Errorf("only on-failure has a maximum retry count")
+		}
+	case "on-failure":
+		if len(split) > 1 {
+			max, err := strconv.Atoi(split[1])
+			if err != nil || max < 0 {
+				return p, fmt.Errorf("invalid maximum retry count %s", split[1])
+			}
+			p.MaximumRetryCount = max
+		}
+	default:
+		return p, errors.New("expected no, on-failure[:max], always or unless-stopped")
+	}
+	return p, nil
+}
+
+// containerPolicy returns the restart policy of a standalone container. Without restart_policy
+// the restart_policy_condition of the services is used, any meaning always, and
+// restart_max_attempts limits the retries on failure.
+func (o RestartOptions) containerPolicy(condition string) container.RestartPolicy {
+	policy := o.Policy
+	if policy == "" && condition == "any" {
+		policy = "always"
+	} else if policy == "" && condition == "on-failure" {
+		policy = "on-failure"
+	}
+	p, _ := parseRestartPolicy(policy)
+	if p.Name == "on-failure" && p.MaximumRetryCount == 0 && o.MaxAttempts != nil {
+		p.MaximumRetryCount = int(*o.MaxAttempts)
+	}
+	return p
+}
+
+// vnfcState returns the state of a VNFC Instance running in a container in the given state, a
+// container restarting or exited with an error is in ERROR
+func vnfcState(state *types.ContainerState) string {
+	switch {
+	case state == nil || state.Dead || state.Restarting:
+		return "ERROR"
+	case state.Paused:
+		return "INACTIVE"
+	case state.Running:
+		return "ACTIVE"
+	case state.ExitCode != 0:
+		return "ERROR"
+	}
+	return "INACTIVE"
+}
+
+// reportContainerState sets the state of the VNFC Instance from its container and reports the
+// restart count and the last exit code of the container
+func reportContainerState(cli *docker.Client, ctx context.Context, vnfr *catalogue.VirtualNetworkFunctionRecord, vnfc *catalogue.VNFCInstance) error {
+	c, err := cli.ContainerInspect(ctx, vnfc.VCID)
+	if err != nil {
+		return err
+	}
+	vnfc.State = vnfcState(c.State)
+	reportParameter(vnfr, fmt.Sprintf("%s.%s", vnfc.Hostname, restartCountKey), strconv.Itoa(c.RestartCount), "Restarts of the container of the VNFC Instance "+vnfc.Hostname)
+	if c.State != nil {
+		reportParameter(vnfr, fmt.Sprintf("%s.%s", vnfc.Hostname, exitCodeKey), strconv.Itoa(c.State.ExitCode), "Last exit code of the container of the VNFC Instance "+vnfc.Hostname)
+	}
+	return nil
+}
+
+// removeContainerReports removes the configuration parameters reporting the container of a VNFC
+// Instance
+func removeContainerReports(vnfr *catalogue.VirtualNetworkFunctionRecord, hostname string) {
+	removeImageReport(vnfr, hostname)
+	removeParameter(vnfr, fmt.Sprintf("%s.%s", hostname, restartCountKey))
+	removeParameter(vnfr, fmt.Sprintf("%s.%s", hostname, exitCodeKey))
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"docker.io/go-docker/api/types/swarm"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Modes of the services of the mode configuration parameter
+const (
+	ModeReplicated = "replicated"
+	ModeGlobal     = "global"
+)
+
+// Scheduling holds the mode, placement_preferences and platforms configuration parameters of
+// the swarm services
+type Scheduling struct {
+	Mode        string
+	Preferences []string
+	Platforms   []swarm.Platform
+}
+
+func (s *Scheduling) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "mode":
+		if value != ModeReplicated && value != ModeGlobal {
+			err = errors.New("expected replicated or global")
+		}
+		s.Mode = value
+	case "placement_preferences": // placement_preferences looks like spread=node.labels.zone;spread=node.labels.rack
+		s.Preferences = make([]string, 0)
+		for _, pref := range strings.Split(value, ";") {
+			descriptor := strings.TrimPrefix(strings.TrimSpace(pref), "spread=")
+			if !strings.HasPrefix(descriptor, "node.labels.") && !strings.HasPrefix(descriptor, "engine.labels.") {
+				err = fmt.Errorf("expected spread=node.labels.<label> or spread=engine.labels.<label> instead of %s", pref)
+				break
+			}
+			s.Preferences = append(s.Preferences, descriptor)
+		}
+	case "max_replicas_per_node":
+		// swarm enforces it from the api 1.40, go-docker 1.0.0 speaks the api 1.35 and has no field
+		// for it, a VNFR silently deployed without the limit would be worse than a refused one
+		err = errors.New("not implemented, it needs the docker api 1.40 and the VNFM uses the api 1.35")
+	case "platforms": // platforms looks like linux/amd64;linux/arm64
+		s.Platforms = make([]swarm.Platform, 0)
+		for _, platform := range splitList(value) {
+			split := strings.Split(platform, "/")
+			if len(split) != 2 || split[0] == "" || split[1] == "" {
+				err = fmt.Errorf("expected <os>/<architecture> instead of %s", platform)
+				break
+			}
+			s.Platforms = append(s.Platforms, swarm.Platform{OS: split[0], Architecture: split[1]})
+		}
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %s of %s: %v", value, key, err)
+	}
+	return true, nil
+}
+
+// validate checks the syntax of the constraints and the parameters not applying to global
+// services
+func (s Scheduling) validate(constraints []string) error {
+	for _, c := range constraints {
+		if _, _, _, err := parseConstraint(c); err != nil {
+			return err
+		}
+	}
+	if s.Mode == ModeGlobal && len(s.Preferences) > 0 {
+		return errors.New("placement_preferences do not apply to global services")
+	}
+	return nil
+}
+
+// serviceMode returns the mode of the service, replicas is ignored by global services
+func (s Scheduling) serviceMode(replicas uint64) swarm.ServiceMode {
+	if s.Mode == ModeGlobal {
+		return swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	}
+	return swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+}
+
+// placement returns the placement of the tasks of the service
+func (s Scheduling) placement(constraints []string) *swarm.Placement {
+	p := &swarm.Placement{
+		Constraints: constraints,
+		Platforms:   s.Platforms,
+	}
+	for _, descriptor := range s.Preferences {
+		p.Preferences = append(p.Preferences, swarm.PlacementPreference{
+			Spread: &swarm.SpreadOver{SpreadDescriptor: descriptor},
+		})
+	}
+	return p
+}
+
+// parseConstraint splits a constraint like node.labels.zone==eu into its key, operator and
+// value, accepting the keys known by swarm
+func parseConstraint(c string) (string, string, string, error) {
+	op := "=="
+	i := strings.Index(c, op)
+	if j := strings.Index(c, "!="); j >= 0 && (i < 0 || j < i) {
+		op, i = "!=", j
+	}
+	if i < 0 {
+		return "", "", "", fmt.Errorf("constraint %s has no == or != operator", c)
+	}
+	key := strings.TrimSpace(c[:i])
+	value := strings.TrimSpace(c[i+len(op):])
+	if value == "" {
+		return "", "", "", fmt.Errorf("constraint %s has no value", c)
+	}
+	switch {
+	case key == "node.id", key == "node.hostname", key == "node.platform.os", key == "node.platform.arch":
+	case key == "node.role":
+		if value != "manager" && value != "worker" {
+			return "", "", "", fmt.Errorf("constraint %s: the role is manager or worker", c)
+		}
+	case strings.HasPrefix(key, "node.labels.") && len(key) > len("node.labels."):
+	case strings.HasPrefix(key, "engine.labels.") && len(key) > len("engine.labels."):
+	default:
+		return "", "", "", fmt.Errorf("constraint %s has the unknown key %s", c, key)
+	}
+	return key, op, value, nil
+}
@@ -0,0 +1,348 @@
+package handler
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/swarm"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretsDir is the directory of the containers where the secrets are mounted
+const secretsDir = "/run/secrets"
+
+// SecretSource returns the value of a secret given the reference found in the configuration
+// parameter of the VNFD
+type SecretSource interface {
+	Secret(ref string) ([]byte, error)
+}
+
+// NewSecretSource returns a Vault compatible source for an http(s) address, using the token in
+// the VAULT_TOKEN environment variable, or an encrypted file source otherwise
+func NewSecretSource(address, keyFile string) (SecretSource, error) {
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return &VaultSecretSource{
+			Address: strings.TrimSuffix(address, "/"),
+			Token:   os.Getenv("VAULT_TOKEN"),
+			Client:  &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	key, err := ReadSecretsKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return LoadFileSecretSource(address, key)
+}
+
+// FileSecretSource holds the secrets of a local file encrypted with AES-GCM. The file contains the
+// nonce followed by the encrypted json object mapping the references to the values.
+type FileSecretSource struct {
+	secrets map[string]string
+}
+
+// LoadFileSecretSource decrypts the secrets file with the key
+func LoadFileSecretSource(file string, key []byte) (*FileSecretSource, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secrets file %s is too short", file)
+	}
+	plain, err := gcm.Open(nil, content[:gcm.NonceSize()], content[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the secrets file %s: %v", file, err)
+	}
+	src := &FileSecretSource{}
+	if err := json.Unmarshal(plain, &src.secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets file %s: %v", file, err)
+	}
+	return src, nil
+}
+
+// EncryptSecrets encrypts the json object of the secrets in the format of the FileSecretSource
+func EncryptSecrets(plain, key []byte) ([]byte, error) {
+	if err := json.Unmarshal(plain, &map[string]string{}); err != nil {
+		return nil, fmt.Errorf("the secrets must be a json object of strings: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadSecretsKey reads a raw or base64 encoded AES key
+func ReadSecretsKey(file string) ([]byte, error) {
+	if file == "" {
+		return nil, errors.New("a key file is required to decrypt the secrets")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); err == nil {
+		return key, nil
+	}
+	return content, nil
+}
+
+func (s *FileSecretSource) Secret(ref string) ([]byte, error) {
+	val, ok := s.secrets[ref]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", ref)
+	}
+	return []byte(val), nil
+}
+
+// VaultSecretSource reads the secrets from the kv engine of a Vault compatible http api. A
+// reference looks like secret/data/mongo#password, the field defaults to value.
+type VaultSecretSource struct {
+	Address string
+	Token   string
+	Client  *http.Client
+}
+
+func (s *VaultSecretSource) Secret(ref string) ([]byte, error) {
+	secretPath, field := ref, "value"
+	if i := strings.LastIndex(ref, "#"); i != -1 {
+		secretPath, field = ref[:i], ref[i+1:]
+	}
+	req, err := http.NewRequest(http.MethodGet, s.Address+path.Join("/v1", secretPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secret %s: vault returned %s", secretPath, resp.Status)
+	}
+	body := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// kv version 2
+		data = nested
+	}
+	val, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no field %s", secretPath, field)
+	}
+	return []byte(val), nil
+}
+
+// resolveSecrets returns the values of the secret configuration parameters of the VNFR. Without
+// a source the value of the parameter is the secret itself.
+func resolveSecrets(source SecretSource, vnfr *catalogue.VirtualNetworkFunctionRecord, names []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(names))
+	if len(names) == 0 {
+		return res, nil
+	}
+	refs := make(map[string]string)
+	if vnfr.Configurations != nil {
+		for _, cp := range vnfr.Configurations.ConfigurationParameters {
+			refs[cp.ConfKey] = cp.Value
+		}
+	}
+	for _, name := range names {
+		ref, ok := refs[name]
+		if !ok {
+			return nil, fmt.Errorf("secret %s is not a configuration parameter", name)
+		}
+		if source == nil {
+			res[name] = []byte(ref)
+			continue
+		}
+		val, err := source.Secret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve secret %s: %v", name, err)
+		}
+		res[name] = val
+	}
+	return res, nil
+}
+
+// secretEnv returns the variables pointing to the files of the secrets, like DB_PASSWORD_FILE
+func secretEnv(names []string) []string {
+	env := make([]string, len(names))
+	for i, name := range names {
+		env[i] = fmt.Sprintf("%s_FILE=%s", name, path.Join(secretsDir, name))
+	}
+	return env
+}
+
+// secretsTmpfs are the options of the tmpfs holding the secrets of a standalone container, the
+// secrets are never written on the disk of the docker host and are gone when the container stops
+const secretsTmpfs = "rw,noexec,nosuid,nodev,size=1m,mode=0755"
+
+// checkSecrets validates a standalone container receiving secrets, they are written after every
+// start by the VNFM so the container can not be restarted by docker, and a container running as a
+// user needs the CHOWN capability to give the secrets to the user
+func checkSecrets(cfg VnfrConfig, secrets map[string][]byte) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	if policy := cfg.Restart.containerPolicy(cfg.RestartPolicy); policy.Name != "" && policy.Name != "no" {
+		return fmt.Errorf("the restart policy %s would start the container without its secrets", policy.Name)
+	}
+	if cfg.Security.User != "" && capDropped(cfg.Security, "CHOWN") {
+		return fmt.Errorf("the secrets can not be given to the user %s without the CHOWN capability", cfg.Security.User)
+	}
+	return nil
+}
+
+// capDropped returns whether a capability is dropped by the security profile and not added back
+func capDropped(security SecurityProfile, capability string) bool {
+	contains := func(caps []string) bool {
+		for _, c := range caps {
+			c = strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+			if c == "ALL" || c == capability {
+				return true
+			}
+		}
+		return false
+	}
+	return contains(security.CapDrop) && !contains(security.CapAdd)
+}
+
+// secretCommand returns the command writing a secret read from stdin, run as root in the
+// container it gives the file to the user the container runs as, chown fails for an unknown user
+func secretCommand(name, user string) []string {
+	script := `rm -f "$1" && umask 0277 && cat > "$1"`
+	if user != "" {
+		script += ` && chown "$2" "$1"`
+	}
+	return []string{"sh", "-c", script, "sh", path.Join(secretsDir, name), user}
+}
+
+// writeSecrets writes the secrets in the tmpfs of a running container, readable only by the user
+// it runs as. The files copied by docker do not reach a tmpfs, the secrets are written by a shell
+// of the container and again after every restart done by the VNFM.
+func writeSecrets(cli *docker.Client, ctx context.Context, containerID string, secrets map[string][]byte) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	c, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeSecret(cli, ctx, containerID, secretCommand(name, c.Config.User), secrets[name]); err != nil {
+			return fmt.Errorf("unable to write the secret %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// writeSecret runs the command writing a secret with the secret as its stdin
+func writeSecret(cli *docker.Client, ctx context.Context, containerID string, cmd []string, secret []byte) error {
+	exec, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		User:         "0",
+		AttachStdin:  true,
+		AttachStdout: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecConfig{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if _, err := resp.Conn.Write(secret); err != nil {
+		return err
+	}
+	if err := resp.CloseWrite(); err != nil {
+		return err
+	}
+	// the output ends when the command exits
+	io.Copy(ioutil.Discard, resp.Reader)
+	var exitCode int
+	err = poll(ctx, fmt.Sprintf("%v in container %s", cmd[:3], containerID), func() (bool, error) {
+		inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+		exitCode = inspect.ExitCode
+		return err == nil && !inspect.Running, err
+	})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d", exitCode)
+	}
+	return nil
+}
+
+// createSecrets creates the docker secrets of the VNFR in a swarm and returns their references
+func createSecrets(cli *docker.Client, ctx context.Context, cfg *VnfrConfig, vim *catalogue.DockerVimInstance, secrets map[string][]byte) ([]*swarm.SecretReference, error) {
+	refs := make([]*swarm.SecretReference, 0, len(secrets))
+	for _, name := range cfg.Secrets {
+		secretName := fmt.Sprintf("%s_%s", cfg.VnfrID, name)
+		resp, err := cli.SecretCreate(ctx, swarm.SecretSpec{
+			Annotations: swarm.Annotations{
+				Name:   secretName,
+				Labels: map[string]string{labelVnfm: "docker", labelVnfrID: cfg.VnfrID},
+			},
+			Data: secrets[name],
+		})
+		if err != nil {
+			return nil, err
+		}
+		cfg.SecretIDs[resp.ID] = vim.ID
+		refs = append(refs, &swarm.SecretReference{
+			SecretID:   resp.ID,
+			SecretName: secretName,
+			File: &swarm.SecretReferenceFileTarget{
+				Name: name,
+				UID:  "0",
+				GID:  "0",
+				Mode: 0444,
+			},
+		})
+	}
+	return refs, nil
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"bytes"
+	"docker.io/go-docker/api/types/container"
+	"docker.io/go-docker/api/types/swarm"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// SecurityProfile holds the security options of the containers. The profile of the VNFM is the
+// default of every VNFR, the configuration parameters of the VNFD override its single options.
+type SecurityProfile struct {
+	CapAdd          []string `json:"cap_add"`
+	CapDrop         []string `json:"cap_drop"`
+	Privileged      bool     `json:"privileged"`
+	ReadOnly        bool     `json:"read_only"`
+	NoNewPrivileges bool     `json:"no_new_privileges"`
+	SeccompProfile  string   `json:"seccomp_profile"`
+	AppArmorProfile string   `json:"apparmor_profile"`
+	User            string   `json:"run_as_user"`
+	GroupAdd        []string `json:"group_add"`
+	UsernsMode      string   `json:"userns_mode"`
+}
+
+// LoadSecurityProfile reads the default security profile of the VNFM from a json file
+func LoadSecurityProfile(file string) (SecurityProfile, error) {
+	profile := SecurityProfile{}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return profile, err
+	}
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return profile, fmt.Errorf("invalid security profile %s: %v", file, err)
+	}
+	_, err = profile.securityOpts()
+	return profile, err
+}
+
+func (s SecurityProfile) clone() SecurityProfile {
+	res := s
+	res.CapAdd = append([]string(nil), s.CapAdd...)
+	res.CapDrop = append([]string(nil), s.CapDrop...)
+	res.GroupAdd = append([]string(nil), s.GroupAdd...)
+	return res
+}
+
+// set overrides an option of the profile with a configuration parameter, it returns false if
+// the key is not a security option
+func (s *SecurityProfile) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "cap_add":
+		s.CapAdd = splitList(value)
+	case "cap_drop":
+		s.CapDrop = splitList(value)
+	case "privileged":
+		s.Privileged, err = strconv.ParseBool(value)
+	case "read_only":
+		s.ReadOnly, err = strconv.ParseBool(value)
+	case "no_new_privileges":
+		s.NoNewPrivileges, err = strconv.ParseBool(value)
+	case "seccomp_profile":
+		s.SeccompProfile = value
+	case "apparmor_profile":
+		s.AppArmorProfile = value
+	case "run_as_user":
+		s.User = value
+	case "group_add":
+		s.GroupAdd = splitList(value)
+	case "userns_mode":
+		s.UsernsMode = value
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %s of %s: %v", value, key, err)
+	}
+	return true, nil
+}
+
+// splitList splits a list separated by ; or ,
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
+
+// securityOpts returns the security options in the format of the docker api, the seccomp
+// profile is read from its file
+func (s SecurityProfile) securityOpts() ([]string, error) {
+	opts := make([]string, 0, 3)
+	if s.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges")
+	}
+	if s.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+s.AppArmorProfile)
+	}
+	if s.SeccompProfile == "unconfined" {
+		opts = append(opts, "seccomp=unconfined")
+	} else if s.SeccompProfile != "" {
+		content, err := ioutil.ReadFile(s.SeccompProfile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the seccomp profile: %v", err)
+		}
+		compact := &bytes.Buffer{}
+		if err := json.Compact(compact, content); err != nil {
+			return nil, fmt.Errorf("invalid seccomp profile %s: %v", s.SeccompProfile, err)
+		}
+		opts = append(opts, "seccomp="+compact.String())
+	}
+	return opts, nil
+}
+
+// applyToContainer sets the options of the profile on the configuration of a container
+func (s SecurityProfile) applyToContainer(config *container.Config, hostCfg *container.HostConfig) error {
+	opts, err := s.securityOpts()
+	if err != nil {
+		return err
+	}
+	config.User = s.User
+	hostCfg.CapAdd = s.CapAdd
+	hostCfg.CapDrop = s.CapDrop
+	hostCfg.Privileged = s.Privileged
+	hostCfg.ReadonlyRootfs = s.ReadOnly
+	hostCfg.SecurityOpt = opts
+	hostCfg.GroupAdd = s.GroupAdd
+	hostCfg.UsernsMode = container.UsernsMode(s.UsernsMode)
+	return nil
+}
+
+// applyToService sets the options of the profile supported by swarm services on the container
+// spec and returns the names of the options that are not supported
+func (s SecurityProfile) applyToService(spec *swarm.ContainerSpec) []string {
+	spec.User = s.User
+	spec.Groups = s.GroupAdd
+	spec.ReadOnly = s.ReadOnly
+	unsupported := make([]string, 0)
+	if len(s.CapAdd) > 0 {
+		unsupported = append(unsupported, "cap_add")
+	}
+	if len(s.CapDrop) > 0 {
+		unsupported = append(unsupported, "cap_drop")
+	}
+	if s.Privileged {
+		unsupported = append(unsupported, "privileged")
+	}
+	if s.NoNewPrivileges {
+		unsupported = append(unsupported, "no_new_privileges")
+	}
+	if s.SeccompProfile != "" {
+		unsupported = append(unsupported, "seccomp_profile")
+	}
+	if s.AppArmorProfile != "" {
+		unsupported = append(unsupported, "apparmor_profile")
+	}
+	if s.UsernsMode != "" {
+		unsupported = append(unsupported, "userns_mode")
+	}
+	return unsupported
+}
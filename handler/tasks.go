@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types/swarm"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// taskTimeout is the time swarm gets to run the tasks of a scaled service
+const taskTimeout = 2 * time.Minute
+
+// Keys of the configuration parameters reporting the tasks of the VNFC Instances, as
+// <hostname>.slot and <hostname>.node, and the virtual ips of the services, as
+// <service>.<network>.service_ip
+const (
+	slotKey      = "slot"
+	nodeKey      = "node"
+	serviceIPKey = "service_ip"
+)
+
+// waitRunningTasks waits until the service runs as many tasks as its replicas. The tasks found
+// are returned with the error on timeout.
+func waitRunningTasks(cli *docker.Client, ctx context.Context, service swarm.Service, timeout time.Duration) ([]swarm.Task, error) {
+	var replicas int
+	if replicated := service.Spec.Mode.Replicated; replicated != nil && replicated.Replicas != nil {
+		replicas = int(*replicated.Replicas)
+	}
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	var tasks []swarm.Task
+	err := poll(ctx, fmt.Sprintf("%d running tasks of service %s", replicas, service.Spec.Name), func() (bool, error) {
+		found, err := runningTasks(cli, ctx, service.ID)
+		if err == nil {
+			tasks = found
+		}
+		return len(tasks) == replicas, err
+	})
+	if err != nil {
+		return tasks, fmt.Errorf("%v, %d running", err, len(tasks))
+	}
+	return tasks, nil
+}
+
+// bindSlots binds the VNFC Instances to the slots of the tasks. An instance keeps its slot while
+// a task runs in it, the others take the free slots in order and stay unbound if none is left.
+func bindSlots(bindings map[string]int, vnfcIDs []string, slots []int) {
+	free := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		free[slot] = true
+	}
+	for _, id := range vnfcIDs {
+		if slot, ok := bindings[id]; ok && free[slot] {
+			free[slot] = false
+			continue
+		}
+		delete(bindings, id)
+	}
+	sorted := append([]int(nil), slots...)
+	sort.Ints(sorted)
+	for _, id := range vnfcIDs {
+		if _, ok := bindings[id]; ok {
+			continue
+		}
+		for _, slot := range sorted {
+			if free[slot] {
+				bindings[id] = slot
+				free[slot] = false
+				break
+			}
+		}
+	}
+}
+
+// bindTasks binds the VNFC Instances of the VDU to the running tasks of its service, the bound
+// ones get the container and the addresses of their task, and returns the slots of the tasks
+func (h *VnfmSwarmHandler) bindTasks(cli *docker.Client, ctx context.Context, cfg *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, vdu *catalogue.VirtualDeploymentUnit) ([]int, error) {
+	// a global service runs one task per node, whatever the number of VNFC Instances
+	if cfg.VduService[vdu.ID].Spec.Mode.Global != nil {
+		return nil, nil
+	}
+	tasks, err := waitRunningTasks(cli, ctx, cfg.VduService[vdu.ID], taskTimeout)
+	slots := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		slots = append(slots, task.Slot)
+	}
+	ids := make([]string, 0, len(vdu.VNFCInstances))
+	for _, vnfc := range vdu.VNFCInstances {
+		if vnfc.ID != "" {
+			ids = append(ids, vnfc.ID)
+		}
+	}
+	bindSlots(cfg.VnfcSlots, ids, slots)
+	bySlot := make(map[int]swarm.Task, len(tasks))
+	for _, task := range tasks {
+		bySlot[task.Slot] = task
+	}
+	for _, vnfc := range vdu.VNFCInstances {
+		if slot, ok := cfg.VnfcSlots[vnfc.ID]; ok && vnfc.ID != "" {
+			setVnfcTask(cli, ctx, cfg, vnfr, vdu.ID, vnfc, bySlot[slot])
+		} else {
+			unsetVnfcTask(cfg, vnfr, vdu.ID, vnfc)
+		}
+	}
+	return slots, err
+}
+
+// setVnfcTask sets the container, the addresses and the name of the task to the VNFC Instance,
+// the slot and the node of the task are reported as configuration parameters
+func setVnfcTask(cli *docker.Client, ctx context.Context, cfg *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, vduID string, vnfc *catalogue.VNFCInstance, task swarm.Task) {
+	service := cfg.VduService[vduID]
+	name := fmt.Sprintf("%s.%d", service.Spec.Name, task.Slot)
+	if vnfc.Hostname != name {
+		removeTaskReports(cfg, vnfr, vnfc.Hostname)
+	}
+	vnfc.Hostname = name
+	vnfc.VCID = task.Status.ContainerStatus.ContainerID
+	vnfc.IPs = taskIPs(task)
+	node := task.NodeID
+	if n, _, err := cli.NodeInspectWithRaw(ctx, task.NodeID); err == nil {
+		node = n.Description.Hostname
+	}
+	reportImage(vnfr, name, service.Spec.TaskTemplate.ContainerSpec.Image)
+	reportParameter(vnfr, fmt.Sprintf("%s.%s", name, slotKey), strconv.Itoa(task.Slot), "Slot of the task of the VNFC Instance "+name)
+	reportParameter(vnfr, fmt.Sprintf("%s.%s", name, nodeKey), node, "Node running the task of the VNFC Instance "+name)
+}
+
+// unsetVnfcTask gives the VNFC Instance without a task the name and the virtual ips of its
+// service
+func unsetVnfcTask(cfg *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, vduID string, vnfc *catalogue.VNFCInstance) {
+	removeTaskReports(cfg, vnfr, vnfc.Hostname)
+	vnfc.Hostname = cfg.BaseHostname
+	vnfc.VCID = ""
+	vnfc.IPs = cfg.serviceIPs(vduID)
+	reportImage(vnfr, cfg.BaseHostname, cfg.VduService[vduID].Spec.TaskTemplate.ContainerSpec.Image)
+}
+
+// removeTaskReports removes the configuration parameters of the task of a VNFC Instance, the
+// ones of the service are kept
+func removeTaskReports(cfg *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, hostname string) {
+	if hostname == cfg.BaseHostname {
+		return
+	}
+	removeImageReport(vnfr, hostname)
+	removeParameter(vnfr, fmt.Sprintf("%s.%s", hostname, slotKey))
+	removeParameter(vnfr, fmt.Sprintf("%s.%s", hostname, nodeKey))
+}
+
+// taskIPs returns the addresses of the task on the networks of the service, the ingress network
+// of the routing mesh excluded
+func taskIPs(task swarm.Task) []*catalogue.IP {
+	res := make([]*catalogue.IP, 0, len(task.NetworksAttachments))
+	for _, attachment := range task.NetworksAttachments {
+		if attachment.Network.Spec.Name == "ingress" || len(attachment.Addresses) == 0 {
+			continue
+		}
+		res = append(res, &catalogue.IP{
+			NetName: attachment.Network.Spec.Name,
+			IP:      strings.Split(attachment.Addresses[0], "/")[0],
+		})
+	}
+	return res
+}
+
+// setServiceIPs records the virtual ips of the service of the VDU and reports them as
+// configuration parameters
+func (c *VnfrConfig) setServiceIPs(vnfr *catalogue.VirtualNetworkFunctionRecord, vduID, serviceName string, ips []*catalogue.IP) {
+	c.ServiceIPs[vduID] = make(map[string]string, len(ips))
+	for _, ip := range ips {
+		c.ServiceIPs[vduID][ip.NetName] = ip.IP
+		reportParameter(vnfr, fmt.Sprintf("%s.%s.%s", serviceName, ip.NetName, serviceIPKey), ip.IP, fmt.Sprintf("Virtual ip of service %s on network %s", serviceName, ip.NetName))
+	}
+}
+
+// serviceIPs returns the virtual ips of the service of the VDU
+func (c *VnfrConfig) serviceIPs(vduID string) []*catalogue.IP {
+	nets := make([]string, 0, len(c.ServiceIPs[vduID]))
+	for netName := range c.ServiceIPs[vduID] {
+		nets = append(nets, netName)
+	}
+	sort.Strings(nets)
+	res := make([]*catalogue.IP, 0, len(nets))
+	for _, netName := range nets {
+		res = append(res, &catalogue.IP{NetName: netName, IP: c.ServiceIPs[vduID][netName]})
+	}
+	return res
+}
+
+// removeTask scales the service of the VDU down by one, the VNFC Instance bound to the slot is
+// already removed from the VDU. Swarm can not remove a given task but removes the tasks not
+// running first: the container of the task in the slot is stopped before, through the docker
+// engine of its node if it runs on another one. If swarm restarts the task in the meantime, or the
+// node is not reachable, it may remove another task: the VNFC Instances of the VDU are then bound
+// again to the remaining tasks and one of them gets the task of the slot.
+func (h *VnfmSwarmHandler) removeTask(ctx context.Context, cfg *VnfrConfig, vnfr *catalogue.VirtualNetworkFunctionRecord, vdu *catalogue.VirtualDeploymentUnit, slot int) error {
+	service := cfg.VduService[vdu.ID]
+	replicated := service.Spec.Mode.Replicated
+	if replicated == nil || replicated.Replicas == nil || *replicated.Replicas == 0 {
+		return fmt.Errorf("service %s has no replica to remove", service.Spec.Name)
+	}
+	cli, registryAuth, err := h.serviceClient(cfg, vdu.ID)
+	if err != nil {
+		return err
+	}
+	tasks, err := runningTasks(cli, ctx, service.ID)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task.Slot != slot {
+			continue
+		}
+		containerID := task.Status.ContainerStatus.ContainerID
+		ncli, err := h.nodeClient(cli, ctx, cfg.VimInstance[vdu.ID], task)
+		if err != nil {
+			h.Logger.Warningf("%s: Container %s of task %s is not reachable, swarm may remove another task: %v", cfg.Name, containerID, task.ID, err)
+			continue
+		}
+		if err := stopContainer(h.Logger, ncli, ctx, cfg.Stop, containerID); err != nil {
+			return fmt.Errorf("unable to stop container %s of task %s: %v", containerID, task.ID, err)
+		}
+	}
+	if err := scaleService(cli, ctx, &service, *replicated.Replicas-1, registryAuth); err != nil {
+		return fmt.Errorf("unable to scale service %s: %v", service.Spec.Name, err)
+	}
+	cfg.VduService[vdu.ID] = service
+	tasks, err = waitRunningTasks(cli, ctx, service, taskTimeout)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task.Slot == slot {
+			h.Logger.Warningf("%s: Swarm kept the task in slot %d of service %s and removed another one, binding the VNFC Instances again", cfg.Name, slot, service.Spec.Name)
+			_, err := h.bindTasks(cli, ctx, cfg, vnfr, vdu)
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeClient returns a client of the docker engine running the container of the task. The engine
+// of another node is reached like the one of the vim instance, with the same port and the same
+// certificates, at the address of the node.
+func (h *VnfmSwarmHandler) nodeClient(cli *docker.Client, ctx context.Context, vim *catalogue.DockerVimInstance, task swarm.Task) (*docker.Client, error) {
+	containerID := task.Status.ContainerStatus.ContainerID
+	if _, err := cli.ContainerInspect(ctx, containerID); err == nil {
+		return cli, nil
+	}
+	node, _, err := cli.NodeInspectWithRaw(ctx, task.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	authURL, err := nodeURL(vim.AuthURL, node.Status.Addr)
+	if err != nil {
+		return nil, err
+	}
+	nodeVim := *vim
+	nodeVim.AuthURL = authURL
+	ncli, err := getClient(&nodeVim, h.CertFolder, h.Tsl)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ncli.ContainerInspect(ctx, containerID); err != nil {
+		return nil, err
+	}
+	return ncli, nil
+}
+
+// nodeURL returns the url of the docker engine of the node at the address, on the port of the
+// engine of the vim instance
+func nodeURL(authURL, addr string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil || u.Port() == "" || addr == "" {
+		return "", fmt.Errorf("the engine of the node at %s can not be derived from %s", addr, authURL)
+	}
+	u.Host = net.JoinHostPort(addr, u.Port())
+	return u.String(), nil
+}
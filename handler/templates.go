@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/swarm"
+	"encoding/hex"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ConfigFile is a go template rendered into a file of the containers
+type ConfigFile struct {
+	Source   string
+	Path     string
+	Template string
+	Digest   string
+}
+
+// templateData is passed to the templates, Foreign contains the parameters of the VNFRs this
+// one depends on, like {{ (index .Foreign "mongo" 0).private }}
+type templateData struct {
+	Name    string
+	Own     map[string]string
+	Foreign map[string][]map[string]string
+}
+
+// ParseConfigFiles parses a list like mongod.conf.tmpl:/etc/mongod.conf;app.yaml:/etc/app.yaml
+func ParseConfigFiles(value string) ([]ConfigFile, error) {
+	res := make([]ConfigFile, 0)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		split := strings.SplitN(entry, ":", 2)
+		if len(split) != 2 || split[0] == "" || !path.IsAbs(split[1]) {
+			return nil, fmt.Errorf("invalid config file %s, expected source:/absolute/path", entry)
+		}
+		res = append(res, ConfigFile{
+			Source: split[0],
+			Path:   path.Clean(split[1]),
+		})
+	}
+	return res, nil
+}
+
+// loadTemplates reads the templates of the config files from the scripts of the VNF package or,
+// if there is no script with that name, from the configuration parameter with that key
+func (c *VnfrConfig) loadTemplates(vnfr *catalogue.VirtualNetworkFunctionRecord, scripts interface{}) error {
+	for i, file := range c.ConfigFiles {
+		tmpl, ok := scriptPayload(scripts, file.Source)
+		if !ok && vnfr.Configurations != nil {
+			for _, cp := range vnfr.Configurations.ConfigurationParameters {
+				if cp.ConfKey == file.Source {
+					tmpl, ok = cp.Value, true
+					delete(c.Own, cp.ConfKey)
+				}
+			}
+		}
+		if !ok {
+			return fmt.Errorf("template %s of %s not found in the scripts nor in the configuration", file.Source, file.Path)
+		}
+		if _, err := parseTemplate(file.Source, tmpl); err != nil {
+			return err
+		}
+		c.ConfigFiles[i].Template = tmpl
+	}
+	return nil
+}
+
+func scriptPayload(scripts interface{}, name string) (string, bool) {
+	switch scripts := scripts.(type) {
+	case []*catalogue.Script:
+		for _, script := range scripts {
+			if script != nil && script.Name == name {
+				return string(script.Payload), true
+			}
+		}
+	case []catalogue.Script:
+		for _, script := range scripts {
+			if script.Name == name {
+				return string(script.Payload), true
+			}
+		}
+	}
+	return "", false
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+// renderConfigFiles renders all the config files and returns them by path, together with true if
+// the content of any of them is different from the last rendering
+func (c *VnfrConfig) renderConfigFiles() (map[string][]byte, bool, error) {
+	res := make(map[string][]byte, len(c.ConfigFiles))
+	changed := false
+	data := templateData{
+		Name:    c.Name,
+		Own:     c.Own,
+		Foreign: c.Foreign,
+	}
+	for i, file := range c.ConfigFiles {
+		tmpl, err := parseTemplate(file.Source, file.Template)
+		if err != nil {
+			return nil, false, err
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return nil, false, fmt.Errorf("unable to render %s: %v", file.Path, err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		digest := hex.EncodeToString(sum[:])
+		if digest != file.Digest {
+			changed = true
+			c.ConfigFiles[i].Digest = digest
+		}
+		res[file.Path] = buf.Bytes()
+	}
+	return res, changed, nil
+}
+
+// copyConfigFiles copies the rendered files into a container as a tar archive
+func copyConfigFiles(cli *docker.Client, ctx context.Context, containerID string, files map[string][]byte) error {
+	if len(files) == 0 {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for filePath, content := range files {
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(filePath, "/"),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cli.CopyToContainer(ctx, containerID, "/", buf, types.CopyToContainerOptions{})
+}
+
+// configDirs returns the directories of the config files
+func configDirs(files map[string][]byte) []string {
+	dirs := make([]string, 0, len(files))
+	for filePath := range files {
+		if dir := path.Dir(filePath); !arrayContains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// reloadContainer makes a container read its changed config files, reload is restart (default),
+// none or the signal to send like SIGHUP
+func reloadContainer(cli *docker.Client, ctx context.Context, containerID, reload string) error {
+	switch strings.ToLower(reload) {
+	case "none":
+		return nil
+	case "", "restart":
+		timeout := 10 * time.Second
+		return cli.ContainerRestart(ctx, containerID, &timeout)
+	default:
+		return cli.ContainerKill(ctx, containerID, reload)
+	}
+}
+
+// createConfigs creates the docker configs of the rendered files in a swarm and returns their
+// references
+func createConfigs(cli *docker.Client, ctx context.Context, cfg *VnfrConfig, vim *catalogue.DockerVimInstance, files map[string][]byte) ([]*swarm.ConfigReference, error) {
+	refs := make([]*swarm.ConfigReference, 0, len(cfg.ConfigFiles))
+	for i, file := range cfg.ConfigFiles {
+		configName := fmt.Sprintf("%s-%d-%s", cfg.VnfrID, i, file.Digest[:12])
+		resp, err := cli.ConfigCreate(ctx, swarm.ConfigSpec{
+			Annotations: swarm.Annotations{
+				Name:   configName,
+				Labels: map[string]string{labelVnfm: "docker", labelVnfrID: cfg.VnfrID},
+			},
+			Data: files[file.Path],
+		})
+		if err != nil {
+			return nil, err
+		}
+		cfg.ConfigIDs[resp.ID] = vim.ID
+		refs = append(refs, &swarm.ConfigReference{
+			ConfigID:   resp.ID,
+			ConfigName: configName,
+			File: &swarm.ConfigReferenceFileTarget{
+				Name: file.Path,
+				UID:  "0",
+				GID:  "0",
+				Mode: 0444,
+			},
+		})
+	}
+	return refs, nil
+}
+
+// patchService applies a change to the spec of a service, the swarm replaces its tasks
+func patchService(cli *docker.Client, ctx context.Context, service *swarm.Service, registryAuth string, patch func(spec *swarm.ServiceSpec)) error {
+	srv, _, err := cli.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return err
+	}
+	patch(&srv.Spec)
+	_, err = cli.ServiceUpdate(ctx, srv.ID, srv.Version, srv.Spec, types.ServiceUpdateOptions{
+		EncodedRegistryAuth: registryAuth,
+	})
+	if err != nil {
+		return err
+	}
+	*service, _, err = cli.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	return err
+}
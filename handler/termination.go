@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/filters"
+	"fmt"
+	"github.com/op/go-logging"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultGracePeriod is the time the processes of a container get to exit before being killed
+const defaultGracePeriod = 10 * time.Second
+
+// Retention policies of the network_retention configuration parameter
+const (
+	NetworksKeep   = "keep"
+	NetworksDelete = "delete"
+)
+
+// StopPolicy holds the stop_signal, stop_grace_period and pre_stop configuration parameters
+type StopPolicy struct {
+	Signal      string
+	GracePeriod time.Duration
+	PreStop     []string
+}
+
+func (p *StopPolicy) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "stop_signal":
+		p.Signal = value
+	case "stop_grace_period":
+		p.GracePeriod, err = time.ParseDuration(value)
+	case "pre_stop":
+		p.PreStop = strings.Fields(value)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %s of %s: %v", value, key, err)
+	}
+	return true, nil
+}
+
+// grace returns the grace period, or the default one, rounded up to the seconds counted by
+// docker so that a period under a second does not kill the container at once
+func (p StopPolicy) grace() time.Duration {
+	if p.GracePeriod > 0 {
+		return (p.GracePeriod + time.Second - 1).Truncate(time.Second)
+	}
+	return defaultGracePeriod
+}
+
+// stopContainer runs the pre stop hook in the container and stops it, sending the stop signal
+// configured when it was created and killing it after the grace period. A failing hook does not
+// prevent the stop.
+func stopContainer(l *logging.Logger, cli *docker.Client, ctx context.Context, stop StopPolicy, containerID string) error {
+	if len(stop.PreStop) > 0 {
+		exitCode, err := execInContainer(cli, ctx, containerID, stop.PreStop, nil, stop.grace())
+		if err == nil && exitCode != 0 {
+			err = fmt.Errorf("exited with %d", exitCode)
+		}
+		if err != nil {
+			l.Warningf("Pre stop hook %v of container %s failed: %v", stop.PreStop, containerID, err)
+		}
+	}
+	timeout := stop.grace()
+	err := cli.ContainerStop(ctx, containerID, &timeout)
+	if err != nil && !docker.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// removeContainer stops the container and removes it, a container already gone is not an error
+func removeContainer(l *logging.Logger, cli *docker.Client, ctx context.Context, stop StopPolicy, containerID string, removeVolumes bool) error {
+	if err := stopContainer(l, cli, ctx, stop, containerID); err != nil {
+		l.Warningf("Error while stopping container %s, it is killed: %v", containerID, err)
+	}
+	err := cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
+		Force:         true,
+		RemoveVolumes: removeVolumes,
+	})
+	if err != nil && !docker.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ownedNetworks returns the names of the networks of the container connected only to the
+// containers of the VNFR, the VNFR is the only one using them and they are removed with it
+func ownedNetworks(cli *docker.Client, ctx context.Context, containerID string, own []string) []string {
+	res := make([]string, 0)
+	c, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil || c.NetworkSettings == nil {
+		return res
+	}
+	for name := range c.NetworkSettings.Networks {
+		net, err := cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+		if err == nil && usedOnlyBy(net, own) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// usedOnlyBy returns whether the containers connected to the network are all in own
+func usedOnlyBy(net types.NetworkResource, own []string) bool {
+	for id := range net.Containers {
+		if !arrayContains(own, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeNetworks removes the networks no container is connected to anymore, the predefined
+// networks, the ingress and the networks still in use are kept
+func removeNetworks(l *logging.Logger, cli *docker.Client, ctx context.Context, names []string) error {
+	failed := make([]string, 0)
+	for _, name := range names {
+		if name == "bridge" || name == "host" || name == "none" {
+			continue
+		}
+		net, err := cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+		if err != nil || net.Ingress || len(net.Containers) > 0 {
+			continue
+		}
+		if err := cli.NetworkRemove(ctx, net.ID); err != nil && !docker.IsErrNotFound(err) {
+			l.Errorf("Error while removing network %s: %v", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		l.Debugf("Removed network %s", name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to remove the networks %v", failed)
+	}
+	return nil
+}
+
+// serviceTasks returns the ids of the tasks of a service
+func serviceTasks(cli *docker.Client, ctx context.Context, serviceID string) ([]string, error) {
+	args := filters.NewArgs()
+	args.Add("service", serviceID)
+	tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		res = append(res, task.ID)
+	}
+	return res, nil
+}
+
+// waitTasksGone waits until swarm removed the tasks of a removed service, the containers of the
+// tasks get the grace period to stop
+func waitTasksGone(cli *docker.Client, ctx context.Context, taskIDs []string, timeout time.Duration) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	err := poll(ctx, fmt.Sprintf("the removal of %d tasks", len(taskIDs)), func() (bool, error) {
+		remaining := make([]string, 0, len(taskIDs))
+		for _, id := range taskIDs {
+			_, _, err := cli.TaskInspectWithRaw(ctx, id)
+			if err == nil {
+				remaining = append(remaining, id)
+			} else if !docker.IsErrNotFound(err) {
+				return false, err
+			}
+		}
+		taskIDs = remaining
+		return len(taskIDs) == 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v, tasks %v still present", err, taskIDs)
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/events"
+	"docker.io/go-docker/api/types/filters"
+	"docker.io/go-docker/api/types/swarm"
+	"errors"
+	"fmt"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failure actions of the update_failure_action configuration parameter
+const (
+	UpdateRollback = "rollback"
+	UpdatePause    = "pause"
+	UpdateContinue = "continue"
+)
+
+// Results of the entries of the image history
+const (
+	ImageUpgraded   = "upgraded"
+	ImageRolledBack = "rolled back"
+	ImagePaused     = "paused"
+	ImagePartial    = "partially upgraded"
+)
+
+// ImageChange is an entry of the image history of a VNFR
+type ImageChange struct {
+	Time   time.Time
+	VduID  string
+	From   string
+	To     string
+	Result string
+	Error  string
+}
+
+// UpdatePolicy holds the update_* configuration parameters used when the image of a VNFR is
+// upgraded, and by swarm whenever it replaces the tasks of a service. The standalone handler
+// replaces one container at a time and ignores Parallelism and Order.
+type UpdatePolicy struct {
+	Parallelism   uint64
+	Delay         time.Duration
+	Monitor       time.Duration
+	FailureAction string
+	Timeout       time.Duration
+	Order         string
+	Rollback      RollbackPolicy
+}
+
+// RollbackPolicy holds the rollback_* configuration parameters of the swarm services, the values
+// not configured are the ones of the update
+type RollbackPolicy struct {
+	Parallelism   uint64
+	Delay         time.Duration
+	Monitor       time.Duration
+	FailureAction string
+	Order         string
+}
+
+func (p *UpdatePolicy) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "update_order":
+		err = validOrder(value)
+		p.Order = value
+	case "rollback_parallelism":
+		p.Rollback.Parallelism, err = strconv.ParseUint(value, 10, 64)
+	case "rollback_delay":
+		p.Rollback.Delay, err = time.ParseDuration(value)
+	case "rollback_monitor":
+		p.Rollback.Monitor, err = time.ParseDuration(value)
+	case "rollback_failure_action":
+		if value != UpdatePause && value != UpdateContinue {
+			err = errors.New("expected pause or continue")
+		}
+		p.Rollback.FailureAction = value
+	case "rollback_order":
+		err = validOrder(value)
+		p.Rollback.Order = value
+	case "update_parallelism":
+		p.Parallelism, err = strconv.ParseUint(value, 10, 64)
+	case "update_delay":
+		p.Delay, err = time.ParseDuration(value)
+	case "update_monitor":
+		p.Monitor, err = time.ParseDuration(value)
+	case "update_timeout":
+		p.Timeout, err = time.ParseDuration(value)
+	case "update_failure_action":
+		if value != UpdateRollback && value != UpdatePause && value != UpdateContinue {
+			err = errors.New("expected rollback, pause or continue")
+		}
+		p.FailureAction = value
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid value %s of %s: %v", value, key, err)
+	}
+	return true, nil
+}
+
+// withDefaults returns the policy with the defaults for the values not configured
+func (p UpdatePolicy) withDefaults() UpdatePolicy {
+	if p.Parallelism == 0 {
+		p.Parallelism = 1
+	}
+	if p.Monitor == 0 {
+		p.Monitor = 5 * time.Second
+	}
+	if p.FailureAction == "" {
+		p.FailureAction = UpdateRollback
+	}
+	if p.Timeout == 0 {
+		p.Timeout = 5 * time.Minute
+	}
+	return p
+}
+
+// validOrder checks the order of the update_order and rollback_order configuration parameters
+func validOrder(order string) error {
+	if order != swarm.UpdateOrderStopFirst && order != swarm.UpdateOrderStartFirst {
+		return errors.New("expected stop-first or start-first")
+	}
+	return nil
+}
+
+// swarmConfig returns the update and the rollback config of a service, by default the rollback
+// is done like the update and pauses if it fails too
+func (p UpdatePolicy) swarmConfig() (*swarm.UpdateConfig, *swarm.UpdateConfig) {
+	p = p.withDefaults()
+	update := &swarm.UpdateConfig{
+		Parallelism:   p.Parallelism,
+		Delay:         p.Delay,
+		Monitor:       p.Monitor,
+		FailureAction: p.FailureAction,
+		Order:         p.Order,
+	}
+	rollback := &swarm.UpdateConfig{
+		Parallelism:   p.Rollback.Parallelism,
+		Delay:         p.Rollback.Delay,
+		Monitor:       p.Rollback.Monitor,
+		FailureAction: p.Rollback.FailureAction,
+		Order:         p.Rollback.Order,
+	}
+	if rollback.Parallelism == 0 {
+		rollback.Parallelism = update.Parallelism
+	}
+	if rollback.Delay == 0 {
+		rollback.Delay = update.Delay
+	}
+	if rollback.Monitor == 0 {
+		rollback.Monitor = update.Monitor
+	}
+	if rollback.FailureAction == "" {
+		rollback.FailureAction = UpdatePause
+	}
+	if rollback.Order == "" {
+		rollback.Order = update.Order
+	}
+	return update, rollback
+}
+
+// imageUpdates returns the new image of every VDU to upgrade. Each line of the payload of the
+// script is an image for all the VDUs or <vdu>=<image> where <vdu> is the name, the id or the
+// parent id of a VDU. An image like :3.6 only changes the tag of the current one.
+func imageUpdates(vnfr *catalogue.VirtualNetworkFunctionRecord, script *catalogue.Script) (map[string]string, error) {
+	if script == nil {
+		return nil, errors.New("no script with the new image provided")
+	}
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(script.Payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) == 1 {
+			for _, vdu := range vnfr.VDUs {
+				res[vdu.ID] = line
+			}
+			continue
+		}
+		name, image := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		found := false
+		for _, vdu := range vnfr.VDUs {
+			if name == vdu.Name || name == vdu.ID || name == vdu.ParentVDU {
+				res[vdu.ID] = image
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown VDU %s in script %s", name, script.Name)
+		}
+		if image == "" {
+			return nil, fmt.Errorf("no image for VDU %s in script %s", name, script.Name)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("script %s does not contain any image", script.Name)
+	}
+	return res, nil
+}
+
+// withTag returns the image, or the repository of the current image with the tag when the
+// image is only a tag like :3.6
+func withTag(current, image string) string {
+	if !strings.HasPrefix(image, ":") {
+		return image
+	}
+	return repositoryOf(current) + image
+}
+
+// addImageChange appends the change to the image history
+func (c *VnfrConfig) addImageChange(change ImageChange, err error) {
+	change.Time = time.Now()
+	if err != nil {
+		change.Error = err.Error()
+	}
+	c.ImageHistory = append(c.ImageHistory, change)
+}
+
+// currentIPs returns the addresses of the container on the networks with a user configured
+// subnet, the only ones where docker accepts a given address
+func currentIPs(cli *docker.Client, ctx context.Context, containerID string) (map[string]string, error) {
+	c, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	if c.NetworkSettings == nil {
+		return res, nil
+	}
+	for netName, settings := range c.NetworkSettings.Networks {
+		if settings == nil || settings.IPAddress == "" {
+			continue
+		}
+		net, err := cli.NetworkInspect(ctx, netName, types.NetworkInspectOptions{})
+		if err != nil || len(net.IPAM.Config) == 0 || net.IPAM.Config[0].Subnet == "" {
+			continue
+		}
+		res[netName] = settings.IPAddress
+	}
+	return res, nil
+}
+
+// withIPs returns a copy of the configuration where the VNFC Instance uses the given addresses on
+// the networks without a fixed ip
+func (c VnfrConfig) withIPs(vduID, scope string, ips map[string]string) VnfrConfig {
+	current := c.networkCfg(vduID, scope)
+	netCfg := make(map[string]NetConf, len(current))
+	for netName, conf := range current {
+		if conf.IpV4Address == "" {
+			conf.IpV4Address = ips[netName]
+		}
+		netCfg[netName] = conf
+	}
+	vnfcs := make(map[string]map[string]NetConf, len(c.VnfcNetworks)+1)
+	for id, v := range c.VnfcNetworks {
+		vnfcs[id] = v
+	}
+	vnfcs[scope] = netCfg
+	c.VnfcNetworks = vnfcs
+	return c
+}
+
+// waitHealthy waits until the health check of the container passes or, without a health check,
+// until the container has been running for the monitor duration. The state of the container is
+// read again on every event of the container, the events are watched before the first read so
+// that no change is missed.
+func waitHealthy(cli *docker.Client, ctx context.Context, containerID string, monitor, timeout time.Duration) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	args.Add("container", containerID)
+	messages, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+	monitored := time.NewTimer(monitor)
+	defer monitored.Stop()
+	what := fmt.Sprintf("container %s to be healthy", containerID)
+	elapsed := false
+	for {
+		c, err := cli.ContainerInspect(ctx, containerID)
+		if err != nil && ctx.Err() != nil {
+			return waitError(ctx, what)
+		}
+		if err != nil {
+			return err
+		}
+		if done, err := containerHealthy(containerID, c.State, elapsed); done || err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return waitError(ctx, what)
+		case <-monitored.C:
+			elapsed = true
+		case <-messages:
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return waitError(ctx, what)
+			}
+			return fmt.Errorf("unable to watch the events of container %s: %v", containerID, err)
+		}
+	}
+}
+
+// containerHealthy returns true if the health check of the container passed or, without a health
+// check, if it is running after the monitor duration elapsed, and an error if the container is
+// unhealthy or exited
+func containerHealthy(containerID string, state *types.ContainerState, elapsed bool) (bool, error) {
+	switch {
+	case state == nil:
+	case state.Health != nil && state.Health.Status == "healthy":
+		return true, nil
+	case state.Health != nil && state.Health.Status == "unhealthy":
+		return false, fmt.Errorf("container %s is unhealthy", containerID)
+	case !state.Running && !state.Restarting:
+		return false, fmt.Errorf("container %s exited with code %d %s", containerID, state.ExitCode, state.Error)
+	case state.Health == nil && state.Running && !state.Restarting && elapsed:
+		return true, nil
+	}
+	return false, nil
+}
+
+// waitServiceUpdate waits until swarm completed the update of the service. An update rolled
+// back or paused by swarm is returned as error.
+func waitServiceUpdate(cli *docker.Client, ctx context.Context, service *swarm.Service, timeout time.Duration) error {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	name := service.Spec.Name
+	err := poll(ctx, fmt.Sprintf("the update of service %s", name), func() (bool, error) {
+		srv, _, err := cli.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			return false, err
+		}
+		*service = srv
+		if status := srv.UpdateStatus; status != nil {
+			switch status.State {
+			case swarm.UpdateStateCompleted:
+				return true, nil
+			case swarm.UpdateStateRollbackCompleted, swarm.UpdateStatePaused, swarm.UpdateStateRollbackPaused:
+				return false, fmt.Errorf("update of service %s %s: %s", name, status.State, status.Message)
+			}
+		}
+		return false, nil
+	})
+	if err != nil && service.UpdateStatus != nil && service.UpdateStatus.State == swarm.UpdateStateUpdating {
+		return fmt.Errorf("%v, still %s: %s", err, service.UpdateStatus.State, service.UpdateStatus.Message)
+	}
+	return err
+}
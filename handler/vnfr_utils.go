@@ -1,14 +1,17 @@
 package handler
 
 import (
+	"context"
 	"docker.io/go-docker"
 	"docker.io/go-docker/api/types"
 	"docker.io/go-docker/api/types/strslice"
 	"docker.io/go-docker/api/types/swarm"
 	"errors"
 	"fmt"
+	"github.com/docker/go-units"
 	"github.com/op/go-logging"
 	"github.com/openbaton/go-openbaton/catalogue"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +21,18 @@ type NetConf struct {
 	IpV4Address string
 }
 
+// VduConfig holds the configuration of the containers of a single VDU. Empty values fall
+// back to the ones of the VnfrConfig.
+type VduConfig struct {
+	ImageName   string
+	ImageDigest string
+	Cmd         strslice.StrSlice
+	Ports       []PortMapping
+	Mnts        []string
+	Own         map[string]string
+	NetworkCfg  map[string]NetConf
+}
+
 type VnfrConfig struct {
 	VnfrID        string
 	ContainerIDs  map[string][]string
@@ -27,7 +42,8 @@ type VnfrConfig struct {
 	BaseHostname  string
 	RestartPolicy string
 	Cmd           strslice.StrSlice
-	PubPort       [][]string
+	Ports         []PortMapping
+	PublishMode   string
 	ExpPort       []string
 	Constraints   []string
 	Mnts          []string
@@ -36,13 +52,48 @@ type VnfrConfig struct {
 	Foreign       map[string][]map[string]string
 	VimInstance   map[string]*catalogue.DockerVimInstance
 	VduService    map[string]swarm.Service
+	Vdus          map[string]VduConfig
+	Placement     string
+	Labels        map[string]string
+	Affinity      map[string]string
+	AntiAffinity  map[string]string
+	Memory        int64
+	NanoCPUs      int64
+	Vims          map[string]*catalogue.DockerVimInstance
+	VduVims       map[string][]string
+	ContainerVim  map[string]string
+	PullPolicy    string
+	ImageDigest   string
+	Security      SecurityProfile
+	Secrets       []string
+	SecretIDs     map[string]string
+	ConfigFiles   []ConfigFile
+	ConfigReload  string
+	ConfigIDs     map[string]string
+	OnDependency  string
+	EnvFormat     string
+	VolumeDriver  VolumeDriver
+	VolumeRetain  string
+	RestoreBackup string
+	Update        UpdatePolicy
+	ImageHistory  []ImageChange
+	Paused        map[string]bool
+	Replicas      map[string]uint64
+	Stop          StopPolicy
+	NetworkRetain string
+	VnfcSlots     map[string]int
+	ServiceIPs    map[string]map[string]string
+	Scheduling    Scheduling
+	Restart       RestartOptions
+	VnfcNetworks  map[string]map[string]NetConf
+	PlacementPos  map[string]int
 }
 
 func NewVnfrConfig(vnfr *catalogue.VirtualNetworkFunctionRecord) VnfrConfig {
 	return VnfrConfig{
 		VnfrID:       vnfr.ID,
 		DNSs:         make([]string, 0),
-		PubPort:      make([][]string, 0),
+		Ports:        make([]PortMapping, 0),
 		ExpPort:      make([]string, 0),
 		Constraints:  make([]string, 0),
 		VimInstance:  make(map[string]*catalogue.DockerVimInstance),
@@ -50,23 +101,343 @@ func NewVnfrConfig(vnfr *catalogue.VirtualNetworkFunctionRecord) VnfrConfig {
 		Own:          make(map[string]string),
 		NetworkCfg:   make(map[string]NetConf),
 		VduService:   make(map[string]swarm.Service),
+		Vdus:         make(map[string]VduConfig),
+		Labels:       make(map[string]string),
+		Vims:         make(map[string]*catalogue.DockerVimInstance),
+		VduVims:      make(map[string][]string),
+		ContainerVim: make(map[string]string),
+		SecretIDs:    make(map[string]string),
+		ConfigIDs:    make(map[string]string),
+		Paused:       make(map[string]bool),
+		Replicas:     make(map[string]uint64),
+		VnfcSlots:    make(map[string]int),
+		ServiceIPs:   make(map[string]map[string]string),
+		VnfcNetworks: make(map[string]map[string]NetConf),
+		PlacementPos: make(map[string]int),
+	}
+}
+
+// ensureMaps initializes the maps missing in configurations persisted by older versions
+func (c *VnfrConfig) ensureMaps() {
+	if c.ContainerIDs == nil {
+		c.ContainerIDs = make(map[string][]string)
+	}
+	if c.Own == nil {
+		c.Own = make(map[string]string)
+	}
+	if c.NetworkCfg == nil {
+		c.NetworkCfg = make(map[string]NetConf)
+	}
+	if c.VnfcNetworks == nil {
+		c.VnfcNetworks = make(map[string]map[string]NetConf)
+	}
+	if c.PlacementPos == nil {
+		c.PlacementPos = make(map[string]int)
+	}
+	if c.VimInstance == nil {
+		c.VimInstance = make(map[string]*catalogue.DockerVimInstance)
+	}
+	if c.VduService == nil {
+		c.VduService = make(map[string]swarm.Service)
+	}
+	if c.Vdus == nil {
+		c.Vdus = make(map[string]VduConfig)
+	}
+	if c.Labels == nil {
+		c.Labels = make(map[string]string)
+	}
+	if c.Vims == nil {
+		c.Vims = make(map[string]*catalogue.DockerVimInstance)
+	}
+	if c.VduVims == nil {
+		c.VduVims = make(map[string][]string)
+	}
+	if c.ContainerVim == nil {
+		c.ContainerVim = make(map[string]string)
+	}
+	if c.SecretIDs == nil {
+		c.SecretIDs = make(map[string]string)
+	}
+	if c.ConfigIDs == nil {
+		c.ConfigIDs = make(map[string]string)
+	}
+	if c.Paused == nil {
+		c.Paused = make(map[string]bool)
+	}
+	if c.Replicas == nil {
+		c.Replicas = make(map[string]uint64)
+	}
+	if c.VnfcSlots == nil {
+		c.VnfcSlots = make(map[string]int)
+	}
+	if c.ServiceIPs == nil {
+		c.ServiceIPs = make(map[string]map[string]string)
+	}
+}
+
+// vimOf returns the vim instance chosen for a VNFC Instance of the VDU
+func (c *VnfrConfig) vimOf(vduID, vimID string) *catalogue.DockerVimInstance {
+	if vim, ok := c.Vims[vimID]; ok {
+		return vim
+	}
+	return c.VimInstance[vduID]
+}
+
+// vimOfContainer returns the vim instance running a container of the VDU
+func (c *VnfrConfig) vimOfContainer(vduID, containerID string) *catalogue.DockerVimInstance {
+	return c.vimOf(vduID, c.ContainerVim[containerID])
+}
+
+func (c *VnfrConfig) addVim(vduID string, vim *catalogue.DockerVimInstance) {
+	c.Vims[vim.ID] = vim
+	if !arrayContains(c.VduVims[vduID], vim.ID) {
+		c.VduVims[vduID] = append(c.VduVims[vduID], vim.ID)
 	}
 }
 
-func FillConfig(vnfr *catalogue.VirtualNetworkFunctionRecord, config *VnfrConfig, l *logging.Logger) Aliases {
+// vduVims returns the candidate vim instances of the VDU
+func (c *VnfrConfig) vduVims(vduID string) []*catalogue.DockerVimInstance {
+	res := make([]*catalogue.DockerVimInstance, 0)
+	for _, id := range c.VduVims[vduID] {
+		res = append(res, c.Vims[id])
+	}
+	if len(res) == 0 && c.VimInstance[vduID] != nil {
+		res = append(res, c.VimInstance[vduID])
+	}
+	return res
+}
+
+func newVduConfig() VduConfig {
+	return VduConfig{
+		Ports:      make([]PortMapping, 0),
+		Own:        make(map[string]string),
+		NetworkCfg: make(map[string]NetConf),
+	}
+}
+
+// Vdu returns the configuration of the VDU with the given id merged with the VNFR wide one
+func (c *VnfrConfig) Vdu(vduID string) VduConfig {
+	vc, ok := c.Vdus[vduID]
+	if !ok {
+		vc = newVduConfig()
+	}
+	if vc.ImageName == "" {
+		vc.ImageName = c.ImageName
+		vc.ImageDigest = c.ImageDigest
+	}
+	if len(vc.Cmd) == 0 {
+		vc.Cmd = c.Cmd
+	}
+	if len(vc.Ports) == 0 {
+		vc.Ports = c.Ports
+	}
+	if len(vc.Mnts) == 0 {
+		vc.Mnts = c.Mnts
+	}
+	if len(vc.NetworkCfg) == 0 {
+		vc.NetworkCfg = c.NetworkCfg
+	}
+	return vc
+}
+
+// networkCfg returns the networks of the container of a VNFC Instance with its fixed ips, see
+// vnfcScope, VNFC Instances without their own use the networks of the VDU
+func (c *VnfrConfig) networkCfg(vduID, scope string) map[string]NetConf {
+	if netCfg, ok := c.VnfcNetworks[scope]; ok {
+		return netCfg
+	}
+	return c.Vdu(vduID).NetworkCfg
+}
+
+// withoutIPs returns the networks without their fixed ips
+func withoutIPs(netCfg map[string]NetConf) map[string]NetConf {
+	res := make(map[string]NetConf, len(netCfg))
+	for netName := range netCfg {
+		res[netName] = NetConf{}
+	}
+	return res
+}
+
+// image returns the image pinned at instantiation, or the image name for older configurations
+func (vc VduConfig) image() string {
+	if vc.ImageDigest != "" {
+		return vc.ImageDigest
+	}
+	return vc.ImageName
+}
+
+func (c *VnfrConfig) setVdu(vduID string, update func(vc *VduConfig)) {
+	vc, ok := c.Vdus[vduID]
+	if !ok {
+		vc = newVduConfig()
+	}
+	update(&vc)
+	c.Vdus[vduID] = vc
+}
+
+// vduOfKey returns the VDU and the key of a configuration parameter like <vdu>.image where
+// <vdu> is the name, the id or the parent id of a VDU of the VNFR
+func vduOfKey(vnfr *catalogue.VirtualNetworkFunctionRecord, confKey string) (*catalogue.VirtualDeploymentUnit, string, bool) {
+	split := strings.SplitN(confKey, ".", 2)
+	if len(split) != 2 {
+		return nil, "", false
+	}
+	for _, vdu := range vnfr.VDUs {
+		if split[0] != "" && (split[0] == vdu.Name || split[0] == vdu.ID || split[0] == vdu.ParentVDU) {
+			return vdu, split[1], true
+		}
+	}
+	return nil, "", false
+}
+
+func fillVduConfig(vc *VduConfig, key, value string) error {
+	kLower := strings.ToLower(key)
+	switch kLower {
+	case "image":
+		vc.ImageName = value
+	case "cmd", "command":
+		vc.Cmd = strings.Split(value, " ")
+	case "publish":
+		ports, err := ParsePortSpecs(value)
+		if err != nil {
+			return err
+		}
+		vc.Ports = append(vc.Ports, ports...)
+	case "volumes":
+		vc.Mnts = strings.Split(value, ";")
+	default:
+		vc.Own[key] = value
+	}
+	return nil
+}
+
+// vduOfComponent returns the VDU the VNFComponent belongs to
+func vduOfComponent(vnfr *catalogue.VirtualNetworkFunctionRecord, component *catalogue.VNFComponent) *catalogue.VirtualDeploymentUnit {
+	for _, vdu := range vnfr.VDUs {
+		for _, vnfc := range vdu.VNFCs {
+			if vnfc == component || (component.ID != "" && vnfc.ID == component.ID) {
+				return vdu
+			}
+		}
+	}
+	for _, vdu := range vnfr.VDUs {
+		if len(vdu.VNFCInstances) < vdu.ScaleInOut {
+			return vdu
+		}
+	}
+	return vnfr.VDUs[0]
+}
+
+func FillConfig(vnfr *catalogue.VirtualNetworkFunctionRecord, config *VnfrConfig, l *logging.Logger) (Aliases, error) {
 	aliases := make(map[string][]string)
 	for _, cp := range vnfr.Configurations.ConfigurationParameters {
+		if vdu, key, ok := vduOfKey(vnfr, cp.ConfKey); ok {
+			var err error
+			config.setVdu(vdu.ID, func(vc *VduConfig) {
+				err = fillVduConfig(vc, key, cp.Value)
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 		kLower := strings.ToLower(cp.ConfKey)
-		if strings.Contains(kLower, "cmd") || strings.Contains(kLower, "command") {
+		if ok, err := config.Security.set(kLower, cp.Value); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+		if ok, err := config.Update.set(kLower, cp.Value); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+		if ok, err := config.Stop.set(kLower, cp.Value); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+		if ok, err := config.Scheduling.set(kLower, cp.Value); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+		if ok, err := config.Restart.set(kLower, cp.Value); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+		if kLower == "secrets" {
+			config.Secrets = splitList(cp.Value)
+		} else if kLower == "config_files" { // config_files looks like mongod.conf.tmpl:/etc/mongod.conf;app.yaml:/etc/app.yaml
+			files, err := ParseConfigFiles(cp.Value)
+			if err != nil {
+				return nil, err
+			}
+			config.ConfigFiles = files
+		} else if kLower == "config_reload" {
+			config.ConfigReload = cp.Value
+		} else if kLower == "on_dependency_change" {
+			if !validDependencyReaction(cp.Value) {
+				return nil, fmt.Errorf("unknown reaction to dependency changes %s", cp.Value)
+			}
+			config.OnDependency = cp.Value
+		} else if kLower == "env_format" {
+			if cp.Value != EnvFlat && cp.Value != EnvIndexed {
+				return nil, fmt.Errorf("unknown env format %s", cp.Value)
+			}
+			config.EnvFormat = cp.Value
+		} else if kLower == "volume_driver" {
+			config.VolumeDriver.Name = cp.Value
+		} else if kLower == "volume_driver_opts" { // volume_driver_opts looks like type=nfs;o=addr=10.0.0.1,rw;device=:/export
+			config.VolumeDriver.Options = ParseLabels(cp.Value)
+		} else if kLower == "volume_retention" {
+			if cp.Value != VolumesKeep && cp.Value != VolumesDelete {
+				return nil, fmt.Errorf("unknown volume retention %s", cp.Value)
+			}
+			config.VolumeRetain = cp.Value
+		} else if kLower == "network_retention" {
+			if cp.Value != NetworksKeep && cp.Value != NetworksDelete {
+				return nil, fmt.Errorf("unknown network retention %s", cp.Value)
+			}
+			config.NetworkRetain = cp.Value
+		} else if kLower == "restore_backup" {
+			config.RestoreBackup = cp.Value
+		} else if kLower == "pull_policy" {
+			if !validPullPolicy(cp.Value) {
+				return nil, fmt.Errorf("unknown pull policy %s", cp.Value)
+			}
+			config.PullPolicy = cp.Value
+		} else if kLower == "placement" {
+			config.Placement = cp.Value
+		} else if kLower == "labels" {
+			config.Labels = ParseLabels(cp.Value)
+		} else if kLower == "affinity" {
+			config.Affinity = ParseLabels(cp.Value)
+		} else if kLower == "anti_affinity" {
+			config.AntiAffinity = ParseLabels(cp.Value)
+		} else if kLower == "memory" {
+			mem, err := units.RAMInBytes(cp.Value)
+			if err != nil {
+				return nil, err
+			}
+			config.Memory = mem
+		} else if kLower == "cpus" {
+			cpus, err := strconv.ParseFloat(cp.Value, 64)
+			if err != nil {
+				return nil, err
+			}
+			config.NanoCPUs = int64(cpus * 1e9)
+		} else if strings.Contains(kLower, "cmd") || strings.Contains(kLower, "command") {
 			config.Cmd = strings.Split(cp.Value, " ")
-		} else if strings.Contains(kLower, "publish") {
-			config.PubPort = append(config.PubPort, strings.FieldsFunc(cp.Value, func(r rune) bool {
-				switch r {
-				case ':', '/':
-					return true
-				}
-				return false
-			}))
+		} else if kLower == "publish_mode" {
+			config.PublishMode = cp.Value
+		} else if strings.Contains(kLower, "publish") { // publish looks like 8080:80;127.0.0.1:5000-5010:5000-5010/udp
+			ports, err := ParsePortSpecs(cp.Value)
+			if err != nil {
+				return nil, err
+			}
+			config.Ports = append(config.Ports, ports...)
 		} else if kLower == "aliases" { // aliases looks like mgmt:name1,name2;net_d:name3,name4
 			if strings.Contains(cp.Value, ";") {
 				for _, val := range strings.Split(cp.Value, ";") {
@@ -101,9 +472,30 @@ func FillConfig(vnfr *catalogue.VirtualNetworkFunctionRecord, config *VnfrConfig
 			config.Own[cp.ConfKey] = cp.Value
 		}
 	}
+	if _, err := config.Security.securityOpts(); err != nil {
+		return nil, err
+	}
+	if err := config.Scheduling.validate(config.Constraints); err != nil {
+		return nil, err
+	}
+	if _, err := parseMounts(config.Mnts); err != nil {
+		return nil, err
+	}
+	for _, vc := range config.Vdus {
+		if _, err := parseMounts(vc.Mnts); err != nil {
+			return nil, err
+		}
+	}
+	// the values of the secrets are resolved when the containers start and never persisted
+	for _, name := range config.Secrets {
+		delete(config.Own, name)
+		for _, vc := range config.Vdus {
+			delete(vc.Own, name)
+		}
+	}
 	config.Name = vnfr.Name
 	l.Debugf("%s: Internal Config is %+v", config.Name, config)
-	return aliases
+	return aliases, nil
 }
 
 func ExtractAliases(val string) (string, []string) {
@@ -117,16 +509,6 @@ func ExtractAliases(val string) (string, []string) {
 	return alias[0], alPerNet
 }
 
-func chooseImage(vdu *catalogue.VirtualDeploymentUnit, vimInstance *catalogue.DockerVimInstance) (string, error) {
-	for _, img := range vimInstance.Images {
-		for _, imgName := range vdu.VMImages {
-			if img.ID == imgName || arrayContains(img.Tags, imgName) {
-				return imgName, nil
-			}
-		}
-	}
-	return "", errors.New(fmt.Sprintf("Image with name or id %v not found", vdu.VMImages))
-}
 func arrayContains(list []string, str string) bool {
 	for _, val := range list {
 		if val == str {
@@ -136,7 +518,17 @@ func arrayContains(list []string, str string) bool {
 	return false
 }
 
-func GetCPsAndIpsFromFixedIps(cl *docker.Client, vnfComponent *catalogue.VNFComponent, l *logging.Logger, vnfr *catalogue.VirtualNetworkFunctionRecord, config VnfrConfig) ([]*catalogue.IP, []*catalogue.VNFDConnectionPoint, []string, error) {
+func removeString(list []string, str string) []string {
+	res := make([]string, 0, len(list))
+	for _, val := range list {
+		if val != str {
+			res = append(res, val)
+		}
+	}
+	return res
+}
+
+func GetCPsAndIpsFromFixedIps(cl *docker.Client, ctx context.Context, vnfComponent *catalogue.VNFComponent, l *logging.Logger, vnfr *catalogue.VirtualNetworkFunctionRecord, config VnfrConfig, netCfg map[string]NetConf) ([]*catalogue.IP, []*catalogue.VNFDConnectionPoint, []string, error) {
 	netNames := make([]string, 0)
 	cps := make([]*catalogue.VNFDConnectionPoint, 0)
 	ips := make([]*catalogue.IP, 0)
@@ -161,12 +553,13 @@ func GetCPsAndIpsFromFixedIps(cl *docker.Client, vnfComponent *catalogue.VNFComp
 			}
 		}
 
-		config.NetworkCfg[cp.VirtualLinkReferenceId] = NetConf{
-			IpV4Address: cp.FixedIp,
-		}
 		var netName string
 		if cp.VirtualLinkReferenceId != "" {
 			netDoc, err := cl.NetworkInspect(ctx, cp.VirtualLinkReferenceId, types.NetworkInspectOptions{})
+			if err != nil {
+				// the id may belong to the network of another vim instance
+				netDoc, err = cl.NetworkInspect(ctx, cp.VirtualLinkReference, types.NetworkInspectOptions{})
+			}
 			if err != nil {
 				l.Errorf("Network with id [%s] not found", cp.VirtualLinkReferenceId)
 				return nil, nil, nil, errors.New(fmt.Sprintf("Network with id [%s] not found", cp.VirtualLinkReferenceId))
@@ -175,6 +568,10 @@ func GetCPsAndIpsFromFixedIps(cl *docker.Client, vnfComponent *catalogue.VNFComp
 		} else {
 			netName = cp.VirtualLinkReference
 		}
+		// networks are stored by name, ids differ between vim instances
+		netCfg[netName] = NetConf{
+			IpV4Address: cp.FixedIp,
+		}
 		newCp := &catalogue.VNFDConnectionPoint{
 			VirtualLinkReference: netName,
 			FloatingIP:           "random",
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types/filters"
+	"docker.io/go-docker/api/types/mount"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/op/go-logging"
+	"github.com/openbaton/go-openbaton/catalogue"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention policies of the volume_retention configuration parameter
+const (
+	VolumesKeep   = "keep"
+	VolumesDelete = "delete"
+)
+
+// labelVnfc is the label of the volumes of a single VNFC Instance
+const labelVnfc = "org.openbaton.vnfc"
+
+// slotTemplate is replaced by swarm with the slot of the task, so that every replica of a
+// service gets its own volume
+const slotTemplate = "{{.Task.Slot}}"
+
+// volumeRemoveTimeout is the time a volume still used by a stopping container gets to be freed
+const volumeRemoveTimeout = 10 * time.Second
+
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// MountSpec is an entry of the volumes configuration parameter:
+//
+//	/host/path:/path[:ro]                 bind mount
+//	name:/path[:ro,per-vnfc,nocopy]       named volume of the VNFR or of every VNFC Instance
+//	tmpfs:/path[:size=64m,mode=1777]      tmpfs
+type MountSpec struct {
+	Type      mount.Type
+	Source    string
+	Target    string
+	ReadOnly  bool
+	PerVnfc   bool
+	NoCopy    bool
+	TmpfsSize int64
+	TmpfsMode os.FileMode
+}
+
+// VolumeDriver holds the driver and its options used to create the named volumes
+type VolumeDriver struct {
+	Name    string
+	Options map[string]string
+}
+
+// ParseMount parses an entry of the volumes configuration parameter
+func ParseMount(value string) (MountSpec, error) {
+	split := strings.SplitN(value, ":", 3)
+	if len(split) < 2 || split[0] == "" || !strings.HasPrefix(split[1], "/") {
+		return MountSpec{}, fmt.Errorf("invalid volume %s, expected source:/path[:options]", value)
+	}
+	m := MountSpec{
+		Source: split[0],
+		Target: split[1],
+	}
+	switch {
+	case m.Source == "tmpfs":
+		m.Type = mount.TypeTmpfs
+		m.Source = ""
+	case strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, "."):
+		m.Type = mount.TypeBind
+	case volumeName.MatchString(m.Source):
+		m.Type = mount.TypeVolume
+	default:
+		return MountSpec{}, fmt.Errorf("invalid volume name %s", m.Source)
+	}
+	if len(split) < 3 {
+		return m, nil
+	}
+	for _, opt := range strings.Split(split[2], ",") {
+		var err error
+		switch {
+		case opt == "ro":
+			m.ReadOnly = true
+		case opt == "rw":
+			m.ReadOnly = false
+		case opt == "per-vnfc" && m.Type == mount.TypeVolume:
+			m.PerVnfc = true
+		case opt == "nocopy" && m.Type == mount.TypeVolume:
+			m.NoCopy = true
+		case strings.HasPrefix(opt, "size=") && m.Type == mount.TypeTmpfs:
+			m.TmpfsSize, err = units.RAMInBytes(strings.TrimPrefix(opt, "size="))
+		case strings.HasPrefix(opt, "mode=") && m.Type == mount.TypeTmpfs:
+			var mode uint64
+			mode, err = strconv.ParseUint(strings.TrimPrefix(opt, "mode="), 8, 32)
+			m.TmpfsMode = os.FileMode(mode)
+		default:
+			return MountSpec{}, fmt.Errorf("invalid option %s of %s volume %s", opt, m.Type, value)
+		}
+		if err != nil {
+			return MountSpec{}, fmt.Errorf("invalid option %s of volume %s: %v", opt, value, err)
+		}
+	}
+	return m, nil
+}
+
+// parseMounts parses the entries of the volumes configuration parameter
+func parseMounts(values []string) ([]MountSpec, error) {
+	res := make([]MountSpec, 0, len(values))
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		m, err := ParseMount(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// toMount returns the mount of a container, scope identifies the VNFC Instance of a per-vnfc
+// volume. The named volumes are created by docker with the labels of the VNFR and the driver.
+func (m MountSpec) toMount(vnfrID, scope string, driver VolumeDriver) mount.Mount {
+	res := mount.Mount{
+		Type:     m.Type,
+		Source:   m.Source,
+		Target:   m.Target,
+		ReadOnly: m.ReadOnly,
+	}
+	switch m.Type {
+	case mount.TypeVolume:
+		labels := map[string]string{labelVnfm: "docker", labelVnfrID: vnfrID}
+		res.Source = fmt.Sprintf("%s_%s", vnfrID, m.Source)
+		if m.PerVnfc {
+			res.Source = fmt.Sprintf("%s_%s", res.Source, scope)
+			labels[labelVnfc] = scope
+		}
+		res.VolumeOptions = &mount.VolumeOptions{
+			NoCopy: m.NoCopy,
+			Labels: labels,
+		}
+		if driver.Name != "" || len(driver.Options) > 0 {
+			res.VolumeOptions.DriverConfig = &mount.Driver{
+				Name:    driver.Name,
+				Options: driver.Options,
+			}
+		}
+	case mount.TypeTmpfs:
+		res.TmpfsOptions = &mount.TmpfsOptions{
+			SizeBytes: m.TmpfsSize,
+			Mode:      m.TmpfsMode,
+		}
+	}
+	return res
+}
+
+// toMounts returns the mounts of the entries of the volumes configuration parameter
+func toMounts(l *logging.Logger, cfg VnfrConfig, mnts []string, scope string) ([]mount.Mount, error) {
+	specs, err := parseMounts(mnts)
+	if err != nil {
+		return nil, err
+	}
+	mounts := make([]mount.Mount, 0, len(specs))
+	for _, spec := range specs {
+		m := spec.toMount(cfg.VnfrID, scope, cfg.VolumeDriver)
+		l.Debugf("%s: Mount %s %s --> %s", cfg.Name, m.Type, m.Source, m.Target)
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// vnfcScope returns the identifier of the per-vnfc volumes of a VNFC Instance, the id of its
+// VNFComponent is kept when the container is recreated
+func vnfcScope(vnfc *catalogue.VNFCInstance) string {
+	if vnfc.VNFComponent != nil && vnfc.VNFComponent.ID != "" {
+		return vnfc.VNFComponent.ID
+	}
+	if vnfc.ID != "" {
+		return vnfc.ID
+	}
+	return vnfc.Hostname
+}
+
+// removeVolumes removes the named volumes of the VNFR on a docker host. Volumes still used by
+// stopping containers are retried for a while.
+func removeVolumes(l *logging.Logger, cli *docker.Client, ctx context.Context, vnfrID string) error {
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", labelVnfrID, vnfrID))
+	resp, err := cli.VolumeList(ctx, args)
+	if err != nil {
+		return err
+	}
+	failed := make([]string, 0)
+	for _, vol := range resp.Volumes {
+		if err := removeVolume(cli, ctx, vol.Name); err != nil {
+			l.Errorf("Error while removing volume %s: %v", vol.Name, err)
+			failed = append(failed, vol.Name)
+			continue
+		}
+		l.Debugf("Removed volume %s", vol.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to remove the volumes %v", failed)
+	}
+	return nil
+}
+
+// removeVolume removes a volume, retrying while it is in use for at most volumeRemoveTimeout
+func removeVolume(cli *docker.Client, ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, volumeRemoveTimeout)
+	defer cancel()
+	var lastErr error
+	err := poll(ctx, fmt.Sprintf("the removal of volume %s", name), func() (bool, error) {
+		lastErr = cli.VolumeRemove(ctx, name, false)
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		return fmt.Errorf("%v: %v", err, lastErr)
+	}
+	return err
+}
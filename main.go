@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 
+	"github.com/op/go-logging"
 	"github.com/openbaton/go-docker-vnfm/handler"
 	"github.com/openbaton/go-openbaton/sdk"
 	"github.com/openbaton/go-openbaton/vnfmsdk"
@@ -19,6 +23,19 @@ func main() {
 	var certFolder = flag.String("cert", "/Users/usr/.docker/machine/machines/myvm1/", "Use Handler for docker swarm services")
 	var tsl = flag.Bool("tsl", false, "Use docker client with tsl")
 	var dirPath = flag.String("dir", "badger", "The directory where to persist the local db")
+	var external = flag.String("external", "", "The external address of the vim instances, like vim-name=1.2.3.4,other-vim=host.example.org")
+	var registryAuth = flag.String("registry-auth", "", "The json file with the credentials of the private registries")
+	var securityProfile = flag.String("security-profile", "", "The json file with the default security options of the containers")
+	var secretSource = flag.String("secrets", "", "The encrypted secrets file or the address of a Vault compatible api, the token is read from VAULT_TOKEN")
+	var secretsKey = flag.String("secrets-key", "", "The file with the AES key of the encrypted secrets file")
+	var encryptSecrets = flag.String("encrypt-secrets", "", "Encrypt the json secrets file with the -secrets-key, write it to stdout and exit")
+	var imagePolicy = flag.String("image-policy", "", "The json file with the allowed images and the keys verifying their signatures")
+	var backupDir = flag.String("backup-dir", "", "The directory where the backups of the volumes are written")
+	var api = flag.String("api", "", "The address of the operator api, like :8090 on the loopback only, pausing the VNFRs and serving the backups with -backup-dir")
+	var apiToken = flag.String("api-token", "", "The file with the token required by the operator api, mandatory if it listens on a non loopback address")
+	var apiCert = flag.String("api-cert", "", "The certificate of the operator api, served over https with -api-key")
+	var apiKey = flag.String("api-key", "", "The private key of the certificate of the operator api")
+	var operationTimeout = flag.Duration("operation-timeout", handler.DefaultTimeout, "The deadline of every lifecycle operation, its docker calls are cancelled after it")
 
 	var typ = flag.String("type", "docker", "The type of the Docker Vim Driver")
 	var name = flag.String("name", "docker", "The docker vnfm name")
@@ -36,6 +53,9 @@ func main() {
 	var timeout = flag.Int("timeout", 2, "Timeout of the Dial function")
 
 	flag.Parse()
+	if *encryptSecrets != "" {
+		os.Exit(encrypt(*encryptSecrets, *secretsKey))
+	}
 	pathExists, err := exists(*dirPath)
 	if err != nil {
 		fmt.Errorf("%v", err)
@@ -50,21 +70,97 @@ func main() {
 	}
 	var h vnfmsdk.HandlerVnfm
 	logger := sdk.GetLogger("docker-vnfm", *level)
-	if *swarm {
-		h = &handler.VnfmSwarmHandler{
+	var credentials *handler.RegistryCredentials
+	if *registryAuth != "" {
+		credentials, err = handler.LoadRegistryCredentials(*registryAuth)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(14)
+		}
+	}
+	var security handler.SecurityProfile
+	if *securityProfile != "" {
+		security, err = handler.LoadSecurityProfile(*securityProfile)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(16)
+		}
+	}
+	var secrets handler.SecretSource
+	if *secretSource != "" {
+		secrets, err = handler.NewSecretSource(*secretSource, *secretsKey)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(17)
+		}
+	}
+	var policy *handler.ImagePolicy
+	if *imagePolicy != "" {
+		policy, err = handler.LoadImagePolicy(*imagePolicy)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(15)
+		}
+	}
+	var backups *handler.Backups
+	if *backupDir != "" {
+		err = os.MkdirAll(*backupDir, 0700)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(18)
+		}
+		backups = &handler.Backups{
+			Dir:        *backupDir,
 			Logger:     logger,
-			Tsl:        *tsl,
 			CertFolder: *certFolder,
+			Tsl:        *tsl,
+			Timeout:    *operationTimeout,
+		}
+	}
+	if *swarm {
+		h = &handler.VnfmSwarmHandler{
+			Logger:            logger,
+			Tsl:               *tsl,
+			CertFolder:        *certFolder,
+			ExternalAddresses: handler.ParseExternalAddresses(*external),
+			Credentials:       credentials,
+			Policy:            policy,
+			Security:          security,
+			Secrets:           secrets,
+			Timeout:           *operationTimeout,
 		}
 	} else {
 		h = &handler.VnfmImpl{
-			Logger:     logger,
-			Tsl:        *tsl,
-			CertFolder: *certFolder,
+			Logger:            logger,
+			Tsl:               *tsl,
+			CertFolder:        *certFolder,
+			ExternalAddresses: handler.ParseExternalAddresses(*external),
+			Credentials:       credentials,
+			Policy:            policy,
+			Security:          security,
+			Secrets:           secrets,
+			Backups:           backups,
+			Timeout:           *operationTimeout,
 		}
 	}
 
 	handler.InitDB(*persist, *dirPath)
+	if *api != "" {
+		operatorApi, err := newOperatorApi(logger, *api, *apiToken, *apiCert, *apiKey, backups)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(19)
+		}
+		operatorApi.Suspender, _ = h.(handler.Suspender)
+		addr, _ := handler.ApiAddress(*api)
+		go func() {
+			if *apiCert != "" {
+				logger.Errorf("Operator api stopped: %v", http.ListenAndServeTLS(addr, *apiCert, *apiKey, operatorApi))
+				return
+			}
+			logger.Errorf("Operator api stopped: %v", http.ListenAndServe(addr, operatorApi))
+		}()
+	}
 	if *configFile != "" {
 		vnfmsdk.Start(*configFile, h, "docker")
 	} else {
@@ -72,6 +168,29 @@ func main() {
 	}
 }
 
+// newOperatorApi checks the options of the operator api, which is served only on the loopback
+// without a token
+func newOperatorApi(logger *logging.Logger, addr, tokenFile, cert, key string, backups *handler.Backups) (*handler.Api, error) {
+	if (cert == "") != (key == "") {
+		return nil, errors.New("the operator api requires both -api-cert and -api-key")
+	}
+	operatorApi := &handler.Api{
+		Logger:  logger,
+		Backups: backups,
+	}
+	if tokenFile != "" {
+		token, err := handler.LoadApiToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		operatorApi.Token = token
+	}
+	if _, loopback := handler.ApiAddress(addr); !loopback && operatorApi.Token == "" {
+		return nil, fmt.Errorf("the operator api on %s requires -api-token", addr)
+	}
+	return operatorApi, nil
+}
+
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -82,3 +201,23 @@ func exists(path string) (bool, error) {
 	}
 	return true, err
 }
+
+func encrypt(file, keyFile string) int {
+	plain, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	key, err := handler.ReadSecretsKey(keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	encrypted, err := handler.EncryptSecrets(plain, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(encrypted)
+	return 0
+}